@@ -0,0 +1,97 @@
+// Copyright © 2021 Bin Liu <bin.liu@enmotech.com>
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/prometheus/common/log"
+	"math"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// adminAPI endpoints operating the exporter: reload, cache flush, circuit breaker reset and list of servers.
+// actions are POST only, and logged along with who requested them
+type adminAPI struct {
+	prefix string           // path prefix of endpoints, empty serve them at root like /reload
+	reload *throttledReload // shared with SIGHUP
+}
+
+// newAdminAPI admin endpoints under prefix, prefix must be empty or start with /
+func newAdminAPI(prefix string, reload *throttledReload) (*adminAPI, error) {
+	if prefix != "" {
+		if !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("admin prefix %s must start with /", prefix)
+		}
+		prefix = path.Clean(prefix)
+		if prefix == "/" {
+			prefix = ""
+		}
+	}
+	return &adminAPI{prefix: prefix, reload: reload}, nil
+}
+
+// routes register admin endpoints on mux, each wrapped by wrap, like basic auth of web config
+func (a *adminAPI) routes(mux *http.ServeMux, wrap func(http.Handler) http.Handler) {
+	mux.Handle(a.prefix+"/reload", wrap(a.action("reload", a.reloadHandler)))
+	mux.Handle(a.prefix+"/cache/flush", wrap(a.action("cache flush", cacheFlushHandler)))
+	mux.Handle(a.prefix+"/breaker/reset", wrap(a.action("circuit breaker reset", breakerResetHandler)))
+	mux.Handle(a.prefix+"/servers", wrap(a.action("server list", serversHandler)))
+}
+
+// action accept POST only and log who requested it
+func (a *adminAPI) action(name string, h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			log.Warnf("admin %s rejected, method %s from %s", name, r.Method, requester(r))
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		log.Infof("admin %s requested by %s", name, requester(r))
+		h(w, r)
+	})
+}
+
+// requester remote address of request, with user of basic auth if any
+func requester(r *http.Request) string {
+	if user, _, ok := r.BasicAuth(); ok {
+		return fmt.Sprintf("%s (user %q)", r.RemoteAddr, user)
+	}
+	return r.RemoteAddr
+}
+
+// reloadHandler rebuild exporter, at most once every reload interval. requests storm is answered 429
+func (a *adminAPI) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	err := a.reload.Reload()
+	var throttled *reloadThrottledError
+	if errors.As(err, &throttled) {
+		w.Header().Set("Retry-After", fmt.Sprintf("%.0f", math.Ceil(throttled.wait.Seconds())))
+		http.Error(w, "reload throttled", http.StatusTooManyRequests)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	if err != nil {
+		w.WriteHeader(500)
+		_, _ = w.Write([]byte(fmt.Sprintf("fail to reload: %s", err.Error())))
+	} else {
+		_, _ = w.Write([]byte(`server reloaded`))
+	}
+}
+
+// cacheFlushHandler drop cached query results, queries run again on next scrape
+func cacheFlushHandler(w http.ResponseWriter, r *http.Request) {
+	n := ogExporter.FlushCache()
+	log.Infof("flushed %d cached query results", n)
+	_, _ = fmt.Fprintf(w, "flushed %d cached query results\n", n)
+}
+
+// serversHandler list servers of configured targets with their up and primary state, password is shadowed
+func serversHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(ogExporter.ServerStatuses())
+}
@@ -0,0 +1,121 @@
+// Copyright © 2021 Bin Liu <bin.liu@enmotech.com>
+
+package main
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"opengauss_exporter/pkg/exporter"
+	"testing"
+	"time"
+)
+
+func Test_newAdminAPI(t *testing.T) {
+	tests := []struct {
+		prefix  string
+		want    string
+		wantErr bool
+	}{
+		{prefix: "", want: ""},
+		{prefix: "/", want: ""},
+		{prefix: "/admin", want: "/admin"},
+		{prefix: "/admin/", want: "/admin"},
+		{prefix: "admin", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.prefix, func(t *testing.T) {
+			got, err := newAdminAPI(tt.prefix, nil)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newAdminAPI() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err == nil {
+				assert.Equal(t, tt.want, got.prefix)
+			}
+		})
+	}
+}
+
+func Test_adminAPI_routes(t *testing.T) {
+	e, err := exporter.NewExporter(exporter.WithNamespace("pg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ogExporter = newOgCollector("pg", e, nil)
+	defer ogExporter.Close()
+
+	var reloads int
+	var reloadErr error
+	reload := newThrottledReload(time.Hour, func() error {
+		reloads++
+		return reloadErr
+	})
+	admin, err := newAdminAPI("/admin", reload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	admin.routes(mux, func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") == "" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	})
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.SetBasicAuth("admin", "secret")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		wantCode int
+	}{
+		{name: "reload_get", method: http.MethodGet, path: "/admin/reload", wantCode: http.StatusMethodNotAllowed},
+		{name: "reload", method: http.MethodPost, path: "/admin/reload", wantCode: http.StatusOK},
+		{name: "reload_throttled", method: http.MethodPost, path: "/admin/reload", wantCode: http.StatusTooManyRequests},
+		{name: "cache_flush_get", method: http.MethodGet, path: "/admin/cache/flush", wantCode: http.StatusMethodNotAllowed},
+		{name: "cache_flush", method: http.MethodPost, path: "/admin/cache/flush", wantCode: http.StatusOK},
+		{name: "breaker_reset", method: http.MethodPost, path: "/admin/breaker/reset?query=pg_up", wantCode: http.StatusOK},
+		{name: "servers_get", method: http.MethodGet, path: "/admin/servers", wantCode: http.StatusMethodNotAllowed},
+		{name: "servers", method: http.MethodPost, path: "/admin/servers", wantCode: http.StatusOK},
+		{name: "without_prefix", method: http.MethodPost, path: "/reload", wantCode: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := serve(tt.method, tt.path); w.Code != tt.wantCode {
+				t.Errorf("%s %s code = %v, want %v", tt.method, tt.path, w.Code, tt.wantCode)
+			}
+		})
+	}
+	assert.Equal(t, 1, reloads)
+	assert.Equal(t, "[]\n", serve(http.MethodPost, "/admin/servers").Body.String())
+
+	// wrap is applied to every endpoint
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/cache/flush", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// throttle expired, failed reload is reported
+	reload.last = time.Now().Add(-time.Hour)
+	reloadErr = errors.New("malformed config")
+	w = serve(http.MethodPost, "/admin/reload")
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, "fail to reload: malformed config", w.Body.String())
+	assert.Equal(t, 2, reloads)
+	assert.NotEmpty(t, serve(http.MethodPost, "/admin/reload").Header().Get("Retry-After"))
+
+	// SIGHUP shares the throttle with admin api
+	var throttled *reloadThrottledError
+	assert.True(t, errors.As(reload.Reload(), &throttled))
+	assert.Equal(t, 2, reloads)
+}
@@ -0,0 +1,18 @@
+// Copyright © 2021 Bin Liu <bin.liu@enmotech.com>
+
+package main
+
+import (
+	"fmt"
+	"github.com/prometheus/common/log"
+	"net/http"
+)
+
+// breakerResetHandler close circuit breakers of failing queries, so they run on next scrape
+// POST <admin prefix>/breaker/reset?query=name , all queries if query is missing
+func breakerResetHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query().Get("query")
+	n := ogExporter.ResetBreakers(query)
+	log.Infof("reset %d circuit breakers of query %q", n, query)
+	_, _ = fmt.Fprintf(w, "reset %d circuit breakers\n", n)
+}
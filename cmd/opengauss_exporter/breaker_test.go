@@ -0,0 +1,39 @@
+// Copyright © 2021 Bin Liu <bin.liu@enmotech.com>
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"opengauss_exporter/pkg/exporter"
+	"testing"
+)
+
+func Test_breakerResetHandler(t *testing.T) {
+	e, err := exporter.NewExporter(exporter.WithNamespace("pg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ogExporter = newOgCollector("pg", e, nil)
+	defer ogExporter.Close()
+
+	tests := []struct {
+		name     string
+		method   string
+		wantCode int
+	}{
+		{name: "get", method: http.MethodGet, wantCode: http.StatusMethodNotAllowed},
+		{name: "post", method: http.MethodPost, wantCode: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			// POST only is enforced by admin api
+			(&adminAPI{}).action("circuit breaker reset", breakerResetHandler).
+				ServeHTTP(w, httptest.NewRequest(tt.method, "/breaker/reset?query=pg_up", nil))
+			if w.Code != tt.wantCode {
+				t.Errorf("breakerResetHandler() code = %v, want %v", w.Code, tt.wantCode)
+			}
+		})
+	}
+}
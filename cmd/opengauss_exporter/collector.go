@@ -0,0 +1,202 @@
+// Copyright © 2021 Bin Liu <bin.liu@enmotech.com>
+
+package main
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"opengauss_exporter/pkg/exporter"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const scrapeTimeoutHeader = "X-Prometheus-Scrape-Timeout-Seconds"
+
+// ogCollector registered once and forward scrapes to current exporter instance.
+// reload swap exporter under write lock, in-flight scrapes are drained before old exporter closed
+type ogCollector struct {
+	lock        sync.RWMutex
+	exporter    *exporter.Exporter
+	authModules map[string]*exporter.AuthModule
+
+	lastReloadSuccessful prometheus.Gauge // 1 if last reload succeeded
+	lastReloadSuccess    prometheus.Gauge // timestamp of last successful reload
+	lastReloadFailure    prometheus.Gauge // timestamp of last failed reload
+}
+
+func newOgCollector(namespace string, e *exporter.Exporter, authModules map[string]*exporter.AuthModule) *ogCollector {
+	c := &ogCollector{
+		exporter:    e,
+		authModules: authModules,
+		lastReloadSuccessful: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace, Subsystem: "exporter", Name: "config_last_reload_successful",
+			Help: "Whether the last configuration reload attempt was successful.",
+		}),
+		lastReloadSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace, Subsystem: "exporter", Name: "config_last_reload_success_timestamp_seconds",
+			Help: "Timestamp of the last successful configuration reload.",
+		}),
+		lastReloadFailure: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace, Subsystem: "exporter", Name: "config_last_reload_failure_timestamp_seconds",
+			Help: "Timestamp of the last failed configuration reload.",
+		}),
+	}
+	c.lastReloadSuccessful.Set(1)
+	c.lastReloadSuccess.SetToCurrentTime()
+	return c
+}
+
+// Describe implement prometheus.Collector. metrics change with reload, so the collector is unchecked
+func (c *ogCollector) Describe(ch chan<- *prometheus.Desc) {
+}
+
+// Collect implement prometheus.Collector
+func (c *ogCollector) Collect(ch chan<- prometheus.Metric) {
+	c.CollectContext(context.Background(), ch)
+}
+
+// CollectContext collect metrics of current exporter, targets not finished before ctx done are reported as down
+func (c *ogCollector) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	c.exporter.CollectContext(ctx, ch)
+	ch <- c.lastReloadSuccessful
+	ch <- c.lastReloadSuccess
+	ch <- c.lastReloadFailure
+}
+
+// Swap replace exporter and auth modules, then close the old exporter
+func (c *ogCollector) Swap(e *exporter.Exporter, authModules map[string]*exporter.AuthModule) {
+	c.lock.Lock()
+	old := c.exporter
+	c.exporter = e
+	c.authModules = authModules
+	c.lock.Unlock()
+
+	c.lastReloadSuccessful.Set(1)
+	c.lastReloadSuccess.SetToCurrentTime()
+	if old != nil {
+		old.Close()
+	}
+}
+
+// ReloadFailed record failed reload, current exporter keep working
+func (c *ogCollector) ReloadFailed() {
+	c.lastReloadSuccessful.Set(0)
+	c.lastReloadFailure.SetToCurrentTime()
+}
+
+// AuthModule lookup auth module by name
+func (c *ogCollector) AuthModule(name string) (*exporter.AuthModule, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	module, ok := c.authModules[name]
+	return module, ok
+}
+
+// Probe collector of single target, scrape with current exporter
+func (c *ogCollector) Probe(ctx context.Context, dsn string) prometheus.Collector {
+	return &probeCollector{c: c, ctx: ctx, dsn: dsn}
+}
+
+// ResetBreakers close circuit breakers of query on current exporter, all queries if query is empty
+func (c *ogCollector) ResetBreakers(query string) int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.exporter.ResetBreakers(query)
+}
+
+// FlushCache drop cached query results of current exporter
+func (c *ogCollector) FlushCache() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.exporter.FlushCache()
+}
+
+// ServerStatuses state of servers of current exporter
+func (c *ogCollector) ServerStatuses() []exporter.ServerStatus {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.exporter.ServerStatuses()
+}
+
+// Close close current exporter
+func (c *ogCollector) Close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.exporter.Close()
+}
+
+// WithContext collector bound to the context of a scrape request
+func (c *ogCollector) WithContext(ctx context.Context) prometheus.Collector {
+	return &contextCollector{c: c, ctx: ctx}
+}
+
+type contextCollector struct {
+	c   *ogCollector
+	ctx context.Context
+}
+
+func (cc *contextCollector) Describe(ch chan<- *prometheus.Desc) {
+}
+
+func (cc *contextCollector) Collect(ch chan<- prometheus.Metric) {
+	cc.c.CollectContext(cc.ctx, ch)
+}
+
+type probeCollector struct {
+	c   *ogCollector
+	ctx context.Context
+	dsn string
+}
+
+func (p *probeCollector) Describe(ch chan<- *prometheus.Desc) {
+}
+
+func (p *probeCollector) Collect(ch chan<- prometheus.Metric) {
+	p.c.lock.RLock()
+	defer p.c.lock.RUnlock()
+	p.c.exporter.NewProbeCollector(p.ctx, p.dsn).Collect(ch)
+}
+
+// metricsHandler scrape with deadline from Prometheus scrape timeout header, minus offset.
+// exporter metrics are gathered from a registry of the request, along with the default registry.
+// requests are counted by promhttp_metric_handler_requests_total like promhttp.Handler
+func metricsHandler(timeoutOffset time.Duration) http.Handler {
+	return promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := scrapeContext(r, timeoutOffset)
+		defer cancel()
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(ogExporter.WithContext(ctx))
+		gatherers := prometheus.Gatherers{prometheus.DefaultGatherer, registry}
+		promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	}))
+}
+
+// scrapeContext context of scrape request, canceled when client go away or scrape timeout
+func scrapeContext(r *http.Request, timeoutOffset time.Duration) (context.Context, context.CancelFunc) {
+	if timeout := scrapeTimeout(r, timeoutOffset); timeout > 0 {
+		return context.WithTimeout(r.Context(), timeout)
+	}
+	return context.WithCancel(r.Context())
+}
+
+// scrapeTimeout parse scrape timeout header, 0 if header is missing or invalid
+func scrapeTimeout(r *http.Request, offset time.Duration) time.Duration {
+	v := r.Header.Get(scrapeTimeoutHeader)
+	if v == "" {
+		return 0
+	}
+	seconds, err := strconv.ParseFloat(v, 64)
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	timeout := time.Duration(seconds * float64(time.Second))
+	if timeout > offset {
+		timeout -= offset
+	}
+	return timeout
+}
@@ -0,0 +1,98 @@
+// Copyright © 2021 Bin Liu <bin.liu@enmotech.com>
+
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http"
+	"net/http/httptest"
+	"opengauss_exporter/pkg/exporter"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_ogCollector_Swap(t *testing.T) {
+	e1, err := exporter.NewExporter(exporter.WithNamespace("pg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newOgCollector("pg", e1, nil)
+	registry := prometheus.NewRegistry()
+	if err = registry.Register(c); err != nil {
+		t.Fatal(err)
+	}
+
+	c.ReloadFailed()
+	if got := testutil.ToFloat64(c.lastReloadSuccessful); got != 0 {
+		t.Errorf("config_last_reload_successful = %v, want 0", got)
+	}
+
+	e2, err := exporter.NewExporter(exporter.WithNamespace("pg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	modules := map[string]*exporter.AuthModule{"monitor": {Type: "userpass"}}
+	c.Swap(e2, modules)
+	if c.exporter != e2 {
+		t.Errorf("Swap() exporter not replaced")
+	}
+	if _, ok := c.AuthModule("monitor"); !ok {
+		t.Errorf("Swap() auth modules not replaced")
+	}
+	if got := testutil.ToFloat64(c.lastReloadSuccessful); got != 1 {
+		t.Errorf("config_last_reload_successful = %v, want 1", got)
+	}
+	// collector stays registered across swaps
+	if _, err = registry.Gather(); err != nil {
+		t.Errorf("Gather() error = %v", err)
+	}
+	c.Close()
+}
+
+func Test_scrapeTimeout(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		offset time.Duration
+		want   time.Duration
+	}{
+		{name: "missing", header: "", offset: time.Second, want: 0},
+		{name: "invalid", header: "abc", offset: time.Second, want: 0},
+		{name: "offset", header: "10", offset: 500 * time.Millisecond, want: 9500 * time.Millisecond},
+		{name: "offset_too_large", header: "0.5", offset: time.Second, want: 500 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if tt.header != "" {
+				r.Header.Set(scrapeTimeoutHeader, tt.header)
+			}
+			if got := scrapeTimeout(r, tt.offset); got != tt.want {
+				t.Errorf("scrapeTimeout() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_metricsHandler(t *testing.T) {
+	e, err := exporter.NewExporter(exporter.WithNamespace("pg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ogExporter = newOgCollector("pg", e, nil)
+	defer ogExporter.Close()
+
+	handler := metricsHandler(0)
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("metricsHandler() code = %v, want %v", w.Code, http.StatusOK)
+		}
+		if i == 1 && !strings.Contains(w.Body.String(), `promhttp_metric_handler_requests_total{code="200"} 1`) {
+			t.Errorf("metricsHandler() requests of handler are not counted")
+		}
+	}
+}
@@ -5,8 +5,6 @@ package main
 import (
 	"context"
 	"fmt"
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/common/log"
 	"gopkg.in/alecthomas/kingpin.v2"
 	"net/http"
@@ -22,29 +20,43 @@ import (
 
 var (
 	defaultPGURL = "postgresql:///?sslmode=disable"
-	ogExporter   *exporter.Exporter
+	ogExporter   *ogCollector
 	ReloadLock   sync.Mutex
 	args         = &Args{}
 )
 
 // Args General generic options
 type Args struct {
-	Help                   *bool   `short:"h" long:"help" description:"Displays help info"`
-	Version                *bool   `short:"v" long:"version" description:"Displays mtk version"`
-	DbURL                  *string `short:"d" long:"url" description:"openGauss database target url" env:"OG_EXPORTER_URL"`
-	ConfigPath             *string `short:"c" long:"config" description:"path to config dir or file" env:"OG_EXPORTER_CONFIG"`
-	ConstLabels            *string `short:"l" long:"label" description:"constant lables:comma separated list of label=value pair" env:"OG_EXPORTER_LABEL"`
-	ServerTags             *string `short:"t" long:"tags" description:"tags,comma separated list of server tag" env:"OG_EXPORTER_TAG"`
-	DisableCache           *bool   `long:"disable-cache" description:"force not using cache" env:"OG_EXPORTER_DISABLE_CACHE"`
-	AutoDiscovery          *bool   `long:"auto-discovery" description:"automatically scrape all database for given server" env:"OG_EXPORTER_AUTO_DISCOVERY"`
-	ExcludeDatabase        *string `long:"exclude-database" description:"excluded databases when enabling auto-discovery" default:"template0,template1" env:"OG_EXPORTER_EXCLUDE_DATABASE"`
-	ExporterNamespace      *string `long:"namespace" description:"prefix of built-in metrics, (og) by default" env:"OG_EXPORTER_NAMESPACE"`
-	FailFast               *bool   `long:"fail-fast" description:"fail fast instead of waiting during start-up" env:"OG_EXPORTER_FAIL_FAST"`
-	ListenAddress          *string `long:"listen-address" description:"prometheus web server listen address" default:":8080" env:"OG_EXPORTER_LISTEN_ADDRESS"`
-	MetricPath             *string `long:"telemetry-path" description:"URL path under which to expose metrics." default:"/metrics" env:"OG_EXPORTER_TELEMETRY_PATH"`
-	DryRun                 *bool   `long:"dry-run" description:"dry run and print raw configs"`
-	ExplainOnly            *bool   `long:"explain" description:"explain server planned queries"`
-	Parallel               *int    `long:"parallel" description:"Specify the parallelism. \nthe degree of parallelism is now useful query database thread "`
+	Help                   *bool          `short:"h" long:"help" description:"Displays help info"`
+	Version                *bool          `short:"v" long:"version" description:"Displays mtk version"`
+	DbURL                  *string        `short:"d" long:"url" description:"openGauss database target url" env:"OG_EXPORTER_URL"`
+	URLFile                *string        `long:"url-file" description:"file of openGauss database target url, re-read when changed" env:"OG_EXPORTER_URL_FILE"`
+	TargetsConfig          *string        `long:"targets-config" description:"path to targets file, password of target could be read from password_file" env:"OG_EXPORTER_TARGETS_CONFIG"`
+	ConfigPath             *string        `short:"c" long:"config" description:"path to config dir or file" env:"OG_EXPORTER_CONFIG"`
+	ConstLabels            *string        `short:"l" long:"label" description:"constant lables:comma separated list of label=value pair" env:"OG_EXPORTER_LABEL"`
+	ServerTags             *string        `short:"t" long:"tags" description:"tags,comma separated list of server tag" env:"OG_EXPORTER_TAG"`
+	DisableCache           *bool          `long:"disable-cache" description:"force not using cache" env:"OG_EXPORTER_DISABLE_CACHE"`
+	AutoDiscovery          *bool          `long:"auto-discovery" description:"automatically scrape all database for given server" env:"OG_EXPORTER_AUTO_DISCOVERY"`
+	ExcludeDatabase        *string        `long:"exclude-database" description:"excluded databases when enabling auto-discovery" default:"template0,template1" env:"OG_EXPORTER_EXCLUDE_DATABASE"`
+	ExporterNamespace      *string        `long:"namespace" description:"prefix of built-in metrics, (og) by default" env:"OG_EXPORTER_NAMESPACE"`
+	NamespaceQueries       *bool          `long:"namespace-queries" description:"prefix query metrics with namespace" env:"OG_EXPORTER_NAMESPACE_QUERIES"`
+	FailFast               *bool          `long:"fail-fast" description:"fail fast instead of waiting during start-up" env:"OG_EXPORTER_FAIL_FAST"`
+	ListenAddress          *string        `long:"listen-address" description:"prometheus web server listen address" default:":8080" env:"OG_EXPORTER_LISTEN_ADDRESS"`
+	MetricPath             *string        `long:"telemetry-path" description:"URL path under which to expose metrics." default:"/metrics" env:"OG_EXPORTER_TELEMETRY_PATH"`
+	WebConfigFile          *string        `long:"web.config.file" description:"path to web config file of TLS and basic auth" env:"OG_EXPORTER_WEB_CONFIG_FILE"`
+	AdminListenAddress     *string        `long:"web.admin-listen-address" description:"separate listen address of admin api" env:"OG_EXPORTER_WEB_ADMIN_LISTEN_ADDRESS"`
+	AdminPrefix            *string        `long:"web.admin-prefix" description:"path prefix of admin api" env:"OG_EXPORTER_WEB_ADMIN_PREFIX"`
+	AdminWebConfigFile     *string        `long:"web.admin-config.file" description:"path to web config file of admin api" env:"OG_EXPORTER_WEB_ADMIN_CONFIG_FILE"`
+	AdminReloadInterval    *time.Duration `long:"web.admin-reload-interval" description:"min interval between reloads requested by admin api or SIGHUP" default:"5s" env:"OG_EXPORTER_WEB_ADMIN_RELOAD_INTERVAL"`
+	DryRun                 *bool          `long:"dry-run" description:"dry run and print raw configs"`
+	ExplainOnly            *bool          `long:"explain" description:"explain server planned queries"`
+	AuthConfig             *string        `long:"auth-config" description:"path to auth modules file of /probe targets" env:"OG_EXPORTER_AUTH_CONFIG"`
+	AsyncCollect           *bool          `long:"async-collect" description:"run queries in background on their ttl, scrape only serve latest results" env:"OG_EXPORTER_ASYNC_COLLECT"`
+	TargetParallel         *int           `long:"target-parallel" description:"number of targets scraped concurrently" env:"OG_EXPORTER_TARGET_PARALLEL"`
+	TimeoutOffset          *time.Duration `long:"scrape-timeout-offset" description:"offset to subtract from Prometheus scrape timeout" env:"OG_EXPORTER_SCRAPE_TIMEOUT_OFFSET"`
+	Parallel               *int           `long:"parallel" description:"Specify the parallelism. \nthe degree of parallelism is now useful query database thread "`
+	ScrapeBudget           *time.Duration `long:"scrape-budget" description:"max duration of a server scrape, slow queries are skipped" env:"OG_EXPORTER_SCRAPE_BUDGET"`
+	QueryClassLimits       *string        `long:"query-class-limits" description:"max concurrent queries of each class, like heavy=1" env:"OG_EXPORTER_QUERY_CLASS_LIMITS"`
 	DisableSettingsMetrics *bool
 	TimeToString           *bool
 }
@@ -72,6 +84,51 @@ func (a *Args) RetrieveTargetURL() []string {
 	return strings.Split(dsn, ",")
 }
 
+// targetURLProvided true if target url is given by cli-args or env
+func (a *Args) targetURLProvided() bool {
+	return (a.DbURL != nil && *a.DbURL != "") || os.Getenv("PG_EXPORTER_URL") != "" || os.Getenv("DATA_SOURCE_NAME") != ""
+}
+
+// RetrieveTargets priority: cli-args > env > url file > DATA_SOURCE_URI with DATA_SOURCE_USER and DATA_SOURCE_PASS.
+// targets config adds targets, default url is used only if there are no targets at all.
+// files are re-read on every scrape when changed, so rotated credentials take effect without restart
+func (a *Args) RetrieveTargets() ([]string, []exporter.TargetSource, error) {
+	var sources []exporter.TargetSource
+	if a.TargetsConfig != nil && *a.TargetsConfig != "" {
+		log.Infof("retrieve targets from targets config %s", *a.TargetsConfig)
+		source, err := exporter.NewTargetsConfigSource(*a.TargetsConfig)
+		if err != nil {
+			return nil, nil, err
+		}
+		sources = append(sources, source)
+	}
+	if a.targetURLProvided() {
+		return a.RetrieveTargetURL(), sources, nil
+	}
+	if a.URLFile != nil && *a.URLFile != "" {
+		log.Infof("retrieve target url from file %s", *a.URLFile)
+		source, err := exporter.NewURLFileSource(*a.URLFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, append(sources, source), nil
+	}
+	if uri := os.Getenv("DATA_SOURCE_URI"); uri != "" {
+		log.Infof("retrieve target url %s from DATA_SOURCE_URI", exporter.ShadowDSN(uri))
+		source, err := exporter.NewUserPassSource(strings.Split(uri, ","),
+			os.Getenv("DATA_SOURCE_USER"), os.Getenv("DATA_SOURCE_USER_FILE"),
+			os.Getenv("DATA_SOURCE_PASS"), os.Getenv("DATA_SOURCE_PASS_FILE"))
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, append(sources, source), nil
+	}
+	if len(sources) > 0 {
+		return nil, sources, nil
+	}
+	return a.RetrieveTargetURL(), nil, nil
+}
+
 // RetrieveConfig  priority: cli-args > env  > env file path
 func (a *Args) RetrieveConfig() {
 	// priority: cli-args > env  > default settings (check exist)
@@ -98,6 +155,14 @@ func initArgs(args *Args) {
 		Default("").
 		Envar("OG_EXPORTER_URL").
 		String()
+	args.URLFile = kingpin.Flag("url-file", "file of openGauss database target url, one per line. re-read when changed, used if --url is not set").
+		Default("").
+		Envar("OG_EXPORTER_URL_FILE").
+		String()
+	args.TargetsConfig = kingpin.Flag("targets-config", "path to targets file, password of each target could be read from password_file and is re-read when changed, client TLS is set by tls: mode, ca_file, cert_file and key_file.").
+		Default("").
+		Envar("OG_EXPORTER_TARGETS_CONFIG").
+		String()
 	args.ConfigPath = kingpin.Flag("config", "path to config dir or file.").
 		Default("").
 		Envar("OG_EXPORTER_CONFIG").
@@ -106,10 +171,10 @@ func initArgs(args *Args) {
 		Default("").
 		Envar("OG_EXPORTER_CONSTANT_LABELS").
 		String()
-	// args.ServerTags = kingpin.Flag("tags", "tags,comma separated list of server tag").
-	// 	Default("").
-	// 	Envar("OG_EXPORTER_TAG").
-	// 	String()
+	args.ServerTags = kingpin.Flag("tags", "tags,comma separated list of server tag, queries run only on servers satisfy their tags").
+		Default("").
+		Envar("OG_EXPORTER_TAG").
+		String()
 	args.DisableCache = kingpin.Flag("disable-cache", "force not using cache").
 		Default("false").
 		Envar("OG_EXPORTER_DISABLE_CACHE").
@@ -126,6 +191,10 @@ func initArgs(args *Args) {
 		Default("pg").
 		Envar("OG_EXPORTER_NAMESPACE").
 		String()
+	args.NamespaceQueries = kingpin.Flag("namespace-queries", "prefix metrics of user-defined queries with namespace too").
+		Default("false").
+		Envar("OG_EXPORTER_NAMESPACE_QUERIES").
+		Bool()
 	// args.FailFast = kingpin.Flag("fail-fast", "fail fast instead of waiting during start-up").
 	// 	Default("false").
 	// 	Envar("OG_EXPORTER_FAIL_FAST").
@@ -138,6 +207,31 @@ func initArgs(args *Args) {
 		Default("/metrics").
 		Envar("OG_EXPORTER_WEB_TELEMETRY_PATH").
 		String()
+	args.WebConfigFile = kingpin.Flag("web.config.file", "Path to configuration file that can enable TLS or authentication, the format of exporter-toolkit. certificates are reloaded when changed.").
+		Default("").
+		Envar("OG_EXPORTER_WEB_CONFIG_FILE").
+		String()
+	args.AdminListenAddress = kingpin.Flag("web.admin-listen-address", "Separate address to listen on for admin api: reload, cache flush, circuit breaker reset and server list. served along with metrics if empty.").
+		Default("").
+		Envar("OG_EXPORTER_WEB_ADMIN_LISTEN_ADDRESS").
+		String()
+	args.AdminPrefix = kingpin.Flag("web.admin-prefix", "Path prefix of admin api, like /admin.").
+		Default("").
+		Envar("OG_EXPORTER_WEB_ADMIN_PREFIX").
+		String()
+	args.AdminWebConfigFile = kingpin.Flag("web.admin-config.file", "Path to web config file of admin api, the same format as --web.config.file. --web.config.file is used if admin api shares the listener.").
+		Default("").
+		Envar("OG_EXPORTER_WEB_ADMIN_CONFIG_FILE").
+		String()
+	args.AdminReloadInterval = kingpin.Flag("web.admin-reload-interval", "Min interval between reloads requested by admin api or SIGHUP, requests in between are rejected.").
+		Default("5s").
+		Envar("OG_EXPORTER_WEB_ADMIN_RELOAD_INTERVAL").
+		Duration()
+
+	args.AuthConfig = kingpin.Flag("auth-config", "path to auth modules file used by /probe targets.").
+		Default("").
+		Envar("OG_EXPORTER_AUTH_CONFIG").
+		String()
 
 	args.TimeToString = kingpin.Flag("time-to-string", "convert database timestamp to date string.").
 		Default("false").
@@ -154,29 +248,58 @@ func initArgs(args *Args) {
 
 	args.ExplainOnly = kingpin.Flag("explain", "explain server planned queries").
 		Bool()
-	args.Parallel = kingpin.Flag("parallel", "Specify the parallelism. \nthe degree of parallelism is now useful query database thread").
+	args.Parallel = kingpin.Flag("parallel", "Specify the parallelism. \nmax weight of queries running at the same time on all databases, queries over it wait").
 		Default("5").
 		Envar("OG_EXPORTER_PARALLEL").
 		Int()
+	args.ScrapeBudget = kingpin.Flag("scrape-budget", "Max duration of a server scrape, queries whose recent p95 duration could not fit the time left are skipped or served from cache. 0 only use Prometheus scrape timeout.").
+		Default("0s").
+		Envar("OG_EXPORTER_SCRAPE_BUDGET").
+		Duration()
+	args.QueryClassLimits = kingpin.Flag("query-class-limits", "Max concurrent queries of each concurrency class, comma separated list of class=limit, like heavy=1.").
+		Default("").
+		Envar("OG_EXPORTER_QUERY_CLASS_LIMITS").
+		String()
+	args.AsyncCollect = kingpin.Flag("async-collect", "Run queries in background on their ttl, scrape only serve the latest results.").
+		Default("false").
+		Envar("OG_EXPORTER_ASYNC_COLLECT").
+		Bool()
+	args.TargetParallel = kingpin.Flag("target-parallel", "Number of targets scraped concurrently.").
+		Default("4").
+		Envar("OG_EXPORTER_TARGET_PARALLEL").
+		Int()
+	args.TimeoutOffset = kingpin.Flag("scrape-timeout-offset", "Offset to subtract from Prometheus scrape timeout, late targets are reported as down.").
+		Default("500ms").
+		Envar("OG_EXPORTER_SCRAPE_TIMEOUT_OFFSET").
+		Duration()
 
 	log.AddFlags(kingpin.CommandLine)
 }
 
 func newOgExporter(args *Args) (*exporter.Exporter, error) {
-	dsn := args.RetrieveTargetURL()
+	dsn, sources, err := args.RetrieveTargets()
+	if err != nil {
+		return nil, err
+	}
 	ex, err := exporter.NewExporter(
 		exporter.WithDNS(dsn),
+		exporter.WithTargetSources(sources...),
 		exporter.WithConfig(*args.ConfigPath),
 		exporter.WithConstLabels(*args.ConstLabels),
 		exporter.WithCacheDisabled(*args.DisableCache),
 		// exporter.WithFailFast(*args.FailFast),
 		exporter.WithNamespace(*args.ExporterNamespace),
+		exporter.WithNamespaceQueries(*args.NamespaceQueries),
 		exporter.WithAutoDiscovery(*args.AutoDiscovery),
 		exporter.WithExcludeDatabases(*args.ExcludeDatabase),
 		exporter.WithDisableSettingsMetrics(*args.DisableSettingsMetrics),
 		exporter.WithTimeToString(*args.TimeToString),
 		exporter.WithParallel(*args.Parallel),
-		// exporter.WithTags(*args.ServerTags),
+		exporter.WithClassLimits(*args.QueryClassLimits),
+		exporter.WithScrapeBudget(*args.ScrapeBudget),
+		exporter.WithTargetParallel(*args.TargetParallel),
+		exporter.WithAsyncCollect(*args.AsyncCollect),
+		exporter.WithTags(*args.ServerTags),
 	)
 	return ex, err
 
@@ -187,54 +310,95 @@ func Reload() error {
 	defer ReloadLock.Unlock()
 	log.Debugf("reload request received, launch new exporter instance")
 
+	newAuthModules, err := loadAuthModules(args)
+	if err != nil {
+		log.Errorf("fail to reload auth modules: %s", err.Error())
+		ogExporter.ReloadFailed()
+		return err
+	}
 	// create a new exporter
 	newExporter, err := newOgExporter(args)
 	// if launch new exporter failed, do nothing
 	if err != nil {
 		log.Errorf("fail to reload exporter: %s", err.Error())
+		ogExporter.ReloadFailed()
 		return err
 	}
 
+	// swap waits for in-flight scrapes, then close old exporter instance and its connections
 	log.Debugf("shutdown old exporter instance")
-	// if older one exists, close and unregister it
-	// if ogExporter != nil {
-	// 	// DO NOT MANUALLY CLOSE OLD EXPORTER INSTANCE because the stupid implementation of sql.DB
-	// 	// there connection will be automatically released after 1 min
-	// 	prometheus.Unregister(ogExporter)
-	//
-	// }
-	// prometheus.MustRegister(newExporter)
-	ogExporter = newExporter
+	ogExporter.Swap(newExporter, newAuthModules)
 	log.Infof("server reloaded")
 	return nil
 }
 
+// reloadThrottledError reload rejected, the last one was less than interval ago
+type reloadThrottledError struct {
+	wait time.Duration // time left until next reload is accepted
+}
+
+func (e *reloadThrottledError) Error() string {
+	return fmt.Sprintf("reload throttled, retry after %s", e.wait)
+}
+
+// throttledReload rebuild exporter at most once every interval, shared by admin api and SIGHUP so neither storms the databases
+type throttledReload struct {
+	interval time.Duration // min interval between reloads, requests in between are rejected
+	reload   func() error
+
+	mu   sync.Mutex
+	last time.Time
+}
+
+func newThrottledReload(interval time.Duration, reload func() error) *throttledReload {
+	return &throttledReload{interval: interval, reload: reload}
+}
+
+// Reload run reload, *reloadThrottledError is returned if the last one was less than interval ago
+func (t *throttledReload) Reload() error {
+	t.mu.Lock()
+	if wait := t.interval - time.Since(t.last); !t.last.IsZero() && wait > 0 {
+		t.mu.Unlock()
+		log.Warnf("reload throttled, last reload was less than %s ago", t.interval)
+		return &reloadThrottledError{wait: wait}
+	}
+	t.last = time.Now()
+	t.mu.Unlock()
+	return t.reload()
+}
+
 func runApp(args *Args) {
 	// 命令行参数
 	initArgs(args)
 
 	kingpin.Parse()
 
-	var err error
-	ogExporter, err = newOgExporter(args)
+	authModules, err := loadAuthModules(args)
+	if err != nil {
+		log.Errorf("fail to load auth modules: %s", err.Error())
+		return
+	}
+	ex, err := newOgExporter(args)
 	if err != nil {
 		log.Errorf("fail to reload exporter: %s", err.Error())
 		return
 	}
 
 	if *args.DryRun {
-		queryList, err := ogExporter.PrintMetricsList()
+		queryList, err := ex.PrintMetricsList()
 		if err != nil {
 			log.Error(err)
 		}
 		fmt.Println(queryList)
 		return
 	}
-	prometheus.MustRegister(ogExporter)
+	ogExporter = newOgCollector(*args.ExporterNamespace, ex, authModules)
 	defer ogExporter.Close()
 
 	router := http.NewServeMux()
-	router.Handle(*args.MetricPath, promhttp.Handler())
+	router.Handle(*args.MetricPath, metricsHandler(*args.TimeoutOffset))
+	// multi-target probe
+	router.HandleFunc("/probe", probeHandler(*args.TimeoutOffset))
 	// basic information
 	router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
@@ -247,33 +411,66 @@ func runApp(args *Args) {
 		_, _ = w.Write([]byte(payload))
 	})
 
-	// reload interface
-	router.HandleFunc("/reload", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
-		if err := Reload(); err != nil {
-			w.WriteHeader(500)
-			_, _ = w.Write([]byte(fmt.Sprintf("fail to reload: %s", err.Error())))
-		} else {
-			_, _ = w.Write([]byte(`server reloaded`))
+	var loader, adminLoader *webConfigLoader
+	if *args.WebConfigFile != "" {
+		if loader, err = newWebConfigLoader(*args.WebConfigFile); err != nil {
+			log.Errorf("fail to load web config: %s", err.Error())
+			return
 		}
-	})
-
-	log.Infof("og_exporter start, listen on http://%s%s", *args.ListenAddress, *args.MetricPath)
+	}
+	if *args.AdminWebConfigFile != "" {
+		if adminLoader, err = newWebConfigLoader(*args.AdminWebConfigFile); err != nil {
+			log.Errorf("fail to load admin web config: %s", err.Error())
+			return
+		}
+	}
+	reload := newThrottledReload(*args.AdminReloadInterval, Reload)
+	admin, err := newAdminAPI(*args.AdminPrefix, reload)
+	if err != nil {
+		log.Errorf("fail to setup admin api: %s", err.Error())
+		return
+	}
 
-	srv := &http.Server{
-		Addr:        *args.ListenAddress,
-		Handler:     router,
-		ReadTimeout: 5 * time.Second,
+	// admin endpoints: reload, cache flush, circuit breaker reset and server list.
+	// they are served on the same listener unless admin listen address is given, with their own auth if configured
+	mux := http.NewServeMux()
+	mux.Handle("/", webHandler(loader)(router))
+	srv := newHTTPServer(*args.ListenAddress, mux, loader)
+	var adminSrv *http.Server
+	if *args.AdminListenAddress == "" {
+		adminWrap := webHandler(loader)
+		if adminLoader != nil {
+			if config, _ := adminLoader.get(); config.tlsEnabled() {
+				log.Errorf("TLS of admin web config requires a separate admin listen address")
+				return
+			}
+			adminWrap = adminLoader.handler
+		}
+		admin.routes(mux, adminWrap)
+	} else {
+		adminMux := http.NewServeMux()
+		admin.routes(adminMux, webHandler(adminLoader))
+		adminSrv = newHTTPServer(*args.AdminListenAddress, adminMux, adminLoader)
+	}
+	if adminLoader == nil && (adminSrv != nil || loader == nil) {
+		log.Warnf("admin api is served without web config, consider --web.admin-config.file to enable authentication")
 	}
+
+	log.Infof("og_exporter start, listen on %s://%s%s", serverScheme(srv), *args.ListenAddress, *args.MetricPath)
 	go func() {
 		// service connections
-		// if err := srv.ListenAndServeTLS("server.crt", "server.key"); err != nil && err != http.ErrServerClosed {
-		// 	logrus.Fatalf("listen: %s\n", err)
-		// }
-		if err = srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := listenAndServe(srv); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("listen: %s\n", err)
 		}
 	}()
+	if adminSrv != nil {
+		log.Infof("admin api listen on %s://%s%s", serverScheme(adminSrv), *args.AdminListenAddress, admin.prefix)
+		go func() {
+			if err := listenAndServe(adminSrv); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("admin listen: %s\n", err)
+			}
+		}()
+	}
 	closeChan := make(chan struct{}, 1)
 	go func() {
 		sigChan := make(chan os.Signal, 2)
@@ -284,7 +481,7 @@ func runApp(args *Args) {
 			switch sig {
 			case syscall.SIGHUP:
 				log.Infof("signal %s received, reloading", sig)
-				_ = Reload()
+				_ = reload.Reload()
 			default:
 				log.Infof("signal %s received, forcefully terminating", sig)
 				closeChan <- struct{}{}
@@ -298,6 +495,11 @@ func runApp(args *Args) {
 	if err = srv.Shutdown(context.Background()); err != nil {
 		log.Errorf("Server Shutdown: %s", err)
 	}
+	if adminSrv != nil {
+		if err = adminSrv.Shutdown(context.Background()); err != nil {
+			log.Errorf("Admin Server Shutdown: %s", err)
+		}
+	}
 
 }
 
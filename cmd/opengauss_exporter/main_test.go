@@ -3,7 +3,10 @@
 package main
 
 import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
@@ -79,3 +82,75 @@ func TestArgs_RetrieveTargetURL(t *testing.T) {
 		})
 	}
 }
+
+func TestArgs_RetrieveTargets(t *testing.T) {
+	dir := t.TempDir()
+	var (
+		urlFile     = filepath.Join(dir, "url")
+		passFile    = filepath.Join(dir, "pass")
+		targetsFile = filepath.Join(dir, "targets.yaml")
+		url         = "host=127.0.0.1 port=5432 user=gaussdb password=secret"
+		empty       = ""
+	)
+	for path, content := range map[string]string{
+		urlFile:     "host=127.0.0.2 port=5432 user=gaussdb password=secret\n",
+		passFile:    "secret\n",
+		targetsFile: "targets:\n- dsn: host=127.0.0.3 port=5432 user=gaussdb\n  password_file: " + passFile,
+	} {
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	resolve := func(t *testing.T, a *Args) ([]string, []string) {
+		dsn, sources, err := a.RetrieveTargets()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resolved []string
+		for _, source := range sources {
+			dsns, err := source.DSNs()
+			assert.NoError(t, err)
+			resolved = append(resolved, dsns...)
+		}
+		return dsn, resolved
+	}
+
+	t.Run("url", func(t *testing.T) {
+		dsn, resolved := resolve(t, &Args{DbURL: &url, URLFile: &urlFile, TargetsConfig: &targetsFile})
+		assert.Equal(t, []string{url}, dsn)
+		assert.Equal(t, []string{"host=127.0.0.3 password=secret port=5432 user=gaussdb"}, resolved)
+	})
+	t.Run("url_file", func(t *testing.T) {
+		dsn, resolved := resolve(t, &Args{DbURL: &empty, URLFile: &urlFile})
+		assert.Empty(t, dsn)
+		assert.Equal(t, []string{"host=127.0.0.2 port=5432 user=gaussdb password=secret"}, resolved)
+	})
+	t.Run("DATA_SOURCE_URI", func(t *testing.T) {
+		os.Setenv("DATA_SOURCE_URI", "127.0.0.4:5432/postgres")
+		os.Setenv("DATA_SOURCE_USER", "gaussdb")
+		os.Setenv("DATA_SOURCE_PASS_FILE", passFile)
+		defer func() {
+			os.Unsetenv("DATA_SOURCE_URI")
+			os.Unsetenv("DATA_SOURCE_USER")
+			os.Unsetenv("DATA_SOURCE_PASS_FILE")
+		}()
+		dsn, resolved := resolve(t, &Args{DbURL: &empty})
+		assert.Empty(t, dsn)
+		assert.Equal(t, []string{"database=postgres host=127.0.0.4 password=secret port=5432 user=gaussdb"}, resolved)
+	})
+	t.Run("targets_config", func(t *testing.T) {
+		dsn, resolved := resolve(t, &Args{DbURL: &empty, TargetsConfig: &targetsFile})
+		assert.Empty(t, dsn)
+		assert.Equal(t, []string{"host=127.0.0.3 password=secret port=5432 user=gaussdb"}, resolved)
+	})
+	t.Run("default", func(t *testing.T) {
+		dsn, resolved := resolve(t, &Args{DbURL: &empty})
+		assert.Equal(t, []string{defaultPGURL}, dsn)
+		assert.Empty(t, resolved)
+	})
+	t.Run("missing_file", func(t *testing.T) {
+		missing := filepath.Join(dir, "missing")
+		_, _, err := (&Args{DbURL: &empty, URLFile: &missing}).RetrieveTargets()
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,54 @@
+// Copyright © 2021 Bin Liu <bin.liu@enmotech.com>
+
+package main
+
+import (
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/log"
+	"net/http"
+	"opengauss_exporter/pkg/exporter"
+	"time"
+)
+
+// loadAuthModules load named credentials of /probe targets from --auth-config
+func loadAuthModules(args *Args) (map[string]*exporter.AuthModule, error) {
+	if args.AuthConfig == nil || *args.AuthConfig == "" {
+		return map[string]*exporter.AuthModule{}, nil
+	}
+	return exporter.LoadAuthModules(*args.AuthConfig)
+}
+
+// probeHandler scrape a single target with all loaded queries, blackbox_exporter style
+// /probe?target=host:port&auth_module=name
+func probeHandler(timeoutOffset time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		target := params.Get("target")
+		if target == "" {
+			http.Error(w, "target parameter is missing", http.StatusBadRequest)
+			return
+		}
+		var module *exporter.AuthModule
+		if moduleName := params.Get("auth_module"); moduleName != "" {
+			var ok bool
+			if module, ok = ogExporter.AuthModule(moduleName); !ok {
+				http.Error(w, fmt.Sprintf("unknown auth_module %q", moduleName), http.StatusBadRequest)
+				return
+			}
+		}
+		dsn, err := module.ConfigureTarget(target)
+		if err != nil {
+			log.Errorf("invalid probe target: %s", err)
+			http.Error(w, fmt.Sprintf("invalid target: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		ctx, cancel := scrapeContext(r, timeoutOffset)
+		defer cancel()
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(ogExporter.Probe(ctx, dsn))
+		promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	}
+}
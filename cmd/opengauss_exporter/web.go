@@ -0,0 +1,408 @@
+// Copyright © 2021 Bin Liu <bin.liu@enmotech.com>
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/prometheus/common/log"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// webConfig TLS and basic auth of HTTP endpoints, same format as --web.config.file of prometheus exporter-toolkit
+type webConfig struct {
+	TLSConfig  tlsServerConfig   `yaml:"tls_server_config"`
+	HTTPConfig httpServerConfig  `yaml:"http_server_config"`
+	Users      map[string]string `yaml:"basic_auth_users"` // username -> bcrypt hash of password
+}
+
+type tlsServerConfig struct {
+	CertFile                 string   `yaml:"cert_file"`
+	KeyFile                  string   `yaml:"key_file"`
+	ClientAuth               string   `yaml:"client_auth_type"`
+	ClientCAFile             string   `yaml:"client_ca_file"`
+	CipherSuites             []string `yaml:"cipher_suites"`
+	CurvePreferences         []string `yaml:"curve_preferences"`
+	MinVersion               string   `yaml:"min_version"`
+	MaxVersion               string   `yaml:"max_version"`
+	PreferServerCipherSuites bool     `yaml:"prefer_server_cipher_suites"`
+}
+
+type httpServerConfig struct {
+	HTTP2   bool              `yaml:"http2"`
+	Headers map[string]string `yaml:"headers"`
+}
+
+var (
+	tlsVersions = map[string]uint16{
+		"TLS13": tls.VersionTLS13,
+		"TLS12": tls.VersionTLS12,
+		"TLS11": tls.VersionTLS11,
+		"TLS10": tls.VersionTLS10,
+	}
+	tlsCurves = map[string]tls.CurveID{
+		"CurveP256": tls.CurveP256,
+		"CurveP384": tls.CurveP384,
+		"CurveP521": tls.CurveP521,
+		"X25519":    tls.X25519,
+	}
+	clientAuthTypes = map[string]tls.ClientAuthType{
+		"":                           tls.NoClientCert,
+		"NoClientCert":               tls.NoClientCert,
+		"RequestClientCert":          tls.RequestClientCert,
+		"RequireAnyClientCert":       tls.RequireAnyClientCert,
+		"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+		"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+	}
+	// only security headers could be set, the same as exporter-toolkit
+	allowedHeaders = map[string]bool{
+		"Strict-Transport-Security": true,
+		"X-Content-Type-Options":    true,
+		"X-Frame-Options":           true,
+		"X-XSS-Protection":          true,
+		"Content-Security-Policy":   true,
+	}
+)
+
+// loadWebConfig load web config file, relative paths are relative to the file
+func loadWebConfig(path string) (*webConfig, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("fail reading web config file %s: %w", path, err)
+	}
+	c := &webConfig{
+		TLSConfig:  tlsServerConfig{MinVersion: "TLS12", PreferServerCipherSuites: true},
+		HTTPConfig: httpServerConfig{HTTP2: true},
+	}
+	if err = yaml.UnmarshalStrict(content, c); err != nil {
+		return nil, fmt.Errorf("malformed web config file %s: %w", path, err)
+	}
+	dir := filepath.Dir(path)
+	for _, p := range []*string{&c.TLSConfig.CertFile, &c.TLSConfig.KeyFile, &c.TLSConfig.ClientCAFile} {
+		if *p != "" && !filepath.IsAbs(*p) {
+			*p = filepath.Join(dir, *p)
+		}
+	}
+	for header := range c.HTTPConfig.Headers {
+		if !allowedHeaders[http.CanonicalHeaderKey(header)] {
+			return nil, fmt.Errorf("header %s is not allowed in web config", header)
+		}
+	}
+	for user, hash := range c.Users {
+		if _, err = bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("password of basic auth user %s is not a bcrypt hash: %w", user, err)
+		}
+	}
+	return c, nil
+}
+
+// tlsEnabled true if certificate is configured
+func (c *webConfig) tlsEnabled() bool {
+	return c.TLSConfig.CertFile != "" || c.TLSConfig.KeyFile != ""
+}
+
+// newTLSConfig build tls config of server, certificate and client CA are read from files
+func (c *webConfig) newTLSConfig() (*tls.Config, error) {
+	t := c.TLSConfig
+	if t.CertFile == "" {
+		return nil, errors.New("cert_file is missing")
+	}
+	if t.KeyFile == "" {
+		return nil, errors.New("key_file is missing")
+	}
+	cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("fail loading certificate %s: %w", t.CertFile, err)
+	}
+	config := &tls.Config{
+		Certificates:             []tls.Certificate{cert},
+		PreferServerCipherSuites: t.PreferServerCipherSuites,
+		NextProtos:               []string{"http/1.1"},
+	}
+	if c.HTTPConfig.HTTP2 {
+		config.NextProtos = []string{"h2", "http/1.1"}
+	}
+
+	var ok bool
+	if config.MinVersion, ok = tlsVersions[t.MinVersion]; !ok {
+		return nil, fmt.Errorf("unknown TLS version %s", t.MinVersion)
+	}
+	if t.MaxVersion != "" {
+		if config.MaxVersion, ok = tlsVersions[t.MaxVersion]; !ok {
+			return nil, fmt.Errorf("unknown TLS version %s", t.MaxVersion)
+		}
+		if config.MaxVersion < config.MinVersion {
+			return nil, fmt.Errorf("max_version %s is lower than min_version %s", t.MaxVersion, t.MinVersion)
+		}
+	}
+	if len(t.CipherSuites) > 0 {
+		suites := make(map[string]uint16)
+		for _, suite := range tls.CipherSuites() {
+			suites[suite.Name] = suite.ID
+		}
+		for _, name := range t.CipherSuites {
+			id, ok := suites[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown cipher suite %s", name)
+			}
+			config.CipherSuites = append(config.CipherSuites, id)
+		}
+	}
+	for _, name := range t.CurvePreferences {
+		curve, ok := tlsCurves[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve %s", name)
+		}
+		config.CurvePreferences = append(config.CurvePreferences, curve)
+	}
+
+	if config.ClientAuth, ok = clientAuthTypes[t.ClientAuth]; !ok {
+		return nil, fmt.Errorf("unknown client_auth_type %s", t.ClientAuth)
+	}
+	if t.ClientCAFile != "" {
+		if config.ClientAuth == tls.NoClientCert {
+			return nil, errors.New("client_ca_file is set without client_auth_type")
+		}
+		pem, err := ioutil.ReadFile(t.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("fail reading client CA %s: %w", t.ClientCAFile, err)
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in client CA %s", t.ClientCAFile)
+		}
+	} else if config.ClientAuth == tls.VerifyClientCertIfGiven || config.ClientAuth == tls.RequireAndVerifyClientCert {
+		return nil, fmt.Errorf("client_ca_file is required by client_auth_type %s", t.ClientAuth)
+	}
+	return config, nil
+}
+
+// fileStamp modification time and size of a file, zero if file is missing
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func stampFiles(paths ...string) map[string]fileStamp {
+	stamps := make(map[string]fileStamp, len(paths))
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil {
+			stamps[path] = fileStamp{modTime: info.ModTime(), size: info.Size()}
+		} else {
+			stamps[path] = fileStamp{}
+		}
+	}
+	return stamps
+}
+
+// webConfigLoader web config re-read when the config, certificate or client CA file changed,
+// so rotated certificates take effect on new connections without restart.
+// a broken config is logged and the last good one keeps working
+type webConfigLoader struct {
+	path string
+
+	mu        sync.Mutex
+	stamps    map[string]fileStamp
+	config    *webConfig
+	tlsConfig *tls.Config
+
+	authMu    sync.Mutex
+	authCache map[[sha256.Size]byte]bool // verified user, password and hash, bcrypt is slow on purpose
+}
+
+// newWebConfigLoader load web config, errors of config or certificates are returned
+func newWebConfigLoader(path string) (*webConfigLoader, error) {
+	l := &webConfigLoader{path: path, authCache: make(map[[sha256.Size]byte]bool)}
+	if _, _, err := l.load(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// get returns the current web config, reloaded if any of its files changed
+func (l *webConfigLoader) get() (*webConfig, *tls.Config) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.unchanged() {
+		return l.config, l.tlsConfig
+	}
+	if _, _, err := l.load(); err != nil {
+		log.Errorf("fail reloading web config, keep the last one: %s", err)
+		// do not retry until files change again
+		l.stamps = l.currentStamps(l.config)
+		return l.config, l.tlsConfig
+	}
+	log.Infof("web config %s reloaded", l.path)
+	return l.config, l.tlsConfig
+}
+
+// load read web config and its files, must be called with mu held or before loader is shared
+func (l *webConfigLoader) load() (*webConfig, *tls.Config, error) {
+	// stamp before reading, files changed while reading are reloaded next time
+	configStamp := stampFiles(l.path)[l.path]
+	config, err := loadWebConfig(l.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	stamps := l.currentStamps(config)
+	stamps[l.path] = configStamp
+	var tlsConfig *tls.Config
+	if config.tlsEnabled() {
+		if tlsConfig, err = config.newTLSConfig(); err != nil {
+			return nil, nil, err
+		}
+	}
+	l.stamps, l.config, l.tlsConfig = stamps, config, tlsConfig
+	return config, tlsConfig, nil
+}
+
+// currentStamps stamps of config file, and of certificate files of config if it is not nil
+func (l *webConfigLoader) currentStamps(config *webConfig) map[string]fileStamp {
+	if config == nil {
+		return stampFiles(l.path)
+	}
+	return stampFiles(l.path, config.TLSConfig.CertFile, config.TLSConfig.KeyFile, config.TLSConfig.ClientCAFile)
+}
+
+func (l *webConfigLoader) unchanged() bool {
+	current := l.currentStamps(l.config)
+	if len(current) != len(l.stamps) {
+		return false
+	}
+	for path, stamp := range current {
+		if last, ok := l.stamps[path]; !ok || !last.modTime.Equal(stamp.modTime) || last.size != stamp.size {
+			return false
+		}
+	}
+	return true
+}
+
+// serverTLSConfig tls config of http server, every new connection gets the latest certificate
+func (l *webConfigLoader) serverTLSConfig() *tls.Config {
+	getConfig := func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		if _, tlsConfig := l.get(); tlsConfig != nil {
+			return tlsConfig, nil
+		}
+		return nil, errors.New("TLS is not configured")
+	}
+	return &tls.Config{
+		GetConfigForClient: getConfig,
+		// not used as GetConfigForClient always returns a config, http.Server requires a certificate source though
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			tlsConfig, err := getConfig(hello)
+			if err != nil {
+				return nil, err
+			}
+			return &tlsConfig.Certificates[0], nil
+		},
+	}
+}
+
+// handler wrap h with basic auth and headers of web config
+func (l *webConfigLoader) handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config, _ := l.get()
+		for header, value := range config.HTTPConfig.Headers {
+			w.Header().Set(header, value)
+		}
+		if len(config.Users) > 0 {
+			user, password, ok := r.BasicAuth()
+			if !ok || !l.authenticate(config.Users, user, password) {
+				w.Header().Set("WWW-Authenticate", "Basic")
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     []byte // compared for unknown users, so they cost the same time as known users
+)
+
+// authenticate check password of user against bcrypt hash
+func (l *webConfigLoader) authenticate(users map[string]string, user, password string) bool {
+	hash, known := users[user]
+	if !known {
+		dummyHashOnce.Do(func() {
+			dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+		})
+		_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+	key := sha256.Sum256([]byte(user + "\x00" + hash + "\x00" + password))
+	l.authMu.Lock()
+	cached := l.authCache[key]
+	l.authMu.Unlock()
+	if cached {
+		return true
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+		return false
+	}
+	l.authMu.Lock()
+	defer l.authMu.Unlock()
+	if len(l.authCache) >= 100 {
+		l.authCache = make(map[[sha256.Size]byte]bool)
+	}
+	l.authCache[key] = true
+	return true
+}
+
+// webHandler wrap of handlers with basic auth and headers of web config, unchanged if loader is nil
+func webHandler(loader *webConfigLoader) func(http.Handler) http.Handler {
+	if loader == nil {
+		return func(h http.Handler) http.Handler { return h }
+	}
+	return loader.handler
+}
+
+// newHTTPServer http server of handler, served with TLS if web config enables it
+func newHTTPServer(addr string, handler http.Handler, loader *webConfigLoader) *http.Server {
+	srv := &http.Server{
+		Addr:        addr,
+		Handler:     handler,
+		ReadTimeout: 5 * time.Second,
+	}
+	if loader == nil {
+		return srv
+	}
+	if config, _ := loader.get(); config.tlsEnabled() {
+		srv.TLSConfig = loader.serverTLSConfig()
+		if !config.HTTPConfig.HTTP2 {
+			srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		}
+	}
+	return srv
+}
+
+// serverScheme https if server is served with TLS
+func serverScheme(srv *http.Server) string {
+	if srv.TLSConfig != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// listenAndServe serve with TLS if configured, certificates come from TLSConfig of web config
+func listenAndServe(srv *http.Server) error {
+	if srv.TLSConfig != nil {
+		return srv.ListenAndServeTLS("", "")
+	}
+	return srv.ListenAndServe()
+}
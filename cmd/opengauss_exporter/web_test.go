@@ -0,0 +1,233 @@
+// Copyright © 2021 Bin Liu <bin.liu@enmotech.com>
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeWebFile write content and move modification time forward, so the change is seen within the same second
+func writeWebFile(t *testing.T, path string, content []byte) {
+	if err := ioutil.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(time.Duration(len(content)) * time.Second)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// genCert generate a certificate signed by parent, self-signed if parent is nil. returns cert and key in PEM
+func genCert(t *testing.T, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func Test_loadWebConfig(t *testing.T) {
+	dir := t.TempDir()
+	_, _, certPEM, keyPEM := genCert(t, "server", nil, nil)
+	writeWebFile(t, filepath.Join(dir, "server.crt"), certPEM)
+	writeWebFile(t, filepath.Join(dir, "server.key"), keyPEM)
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{name: "empty", content: ""},
+		{name: "basic_auth", content: "basic_auth_users:\n  prometheus: " + string(hash)},
+		{name: "tls", content: "tls_server_config:\n  cert_file: server.crt\n  key_file: server.key\n  min_version: TLS13"},
+		{name: "headers", content: "http_server_config:\n  headers:\n    X-Frame-Options: deny"},
+		{name: "unknown_field", content: "tls_config:\n  cert_file: server.crt", wantErr: true},
+		{name: "plain_password", content: "basic_auth_users:\n  prometheus: secret", wantErr: true},
+		{name: "header_not_allowed", content: "http_server_config:\n  headers:\n    Server: og", wantErr: true},
+		{name: "missing_key", content: "tls_server_config:\n  cert_file: server.crt", wantErr: true},
+		{name: "missing_cert_file", content: "tls_server_config:\n  cert_file: missing.crt\n  key_file: server.key", wantErr: true},
+		{name: "unknown_version", content: "tls_server_config:\n  cert_file: server.crt\n  key_file: server.key\n  min_version: TLS14", wantErr: true},
+		{name: "max_lower_than_min", content: "tls_server_config:\n  cert_file: server.crt\n  key_file: server.key\n  max_version: TLS11", wantErr: true},
+		{name: "unknown_cipher", content: "tls_server_config:\n  cert_file: server.crt\n  key_file: server.key\n  cipher_suites: [TLS_FOO]", wantErr: true},
+		{name: "unknown_client_auth", content: "tls_server_config:\n  cert_file: server.crt\n  key_file: server.key\n  client_auth_type: Always", wantErr: true},
+		{name: "verify_without_ca", content: "tls_server_config:\n  cert_file: server.crt\n  key_file: server.key\n  client_auth_type: RequireAndVerifyClientCert", wantErr: true},
+		{name: "ca_without_client_auth", content: "tls_server_config:\n  cert_file: server.crt\n  key_file: server.key\n  client_ca_file: server.crt", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name+".yml")
+			writeWebFile(t, path, []byte(tt.content))
+			_, err := newWebConfigLoader(path)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newWebConfigLoader() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_webConfigLoader_handler(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "web.yml")
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeWebFile(t, path, []byte("basic_auth_users:\n  prometheus: "+string(hash)+
+		"\nhttp_server_config:\n  headers:\n    X-Content-Type-Options: nosniff"))
+	loader, err := newWebConfigLoader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := loader.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	serve := func(user, password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve("", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "Basic", w.Header().Get("WWW-Authenticate"))
+	assert.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+	assert.Equal(t, http.StatusUnauthorized, serve("prometheus", "wrong").Code)
+	assert.Equal(t, http.StatusUnauthorized, serve("unknown", "secret").Code)
+	for i := 0; i < 2; i++ {
+		w = serve("prometheus", "secret")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "ok", w.Body.String())
+	}
+
+	// users are reloaded, cached result of old hash is not used
+	writeWebFile(t, path, []byte("basic_auth_users: {}"))
+	assert.Equal(t, http.StatusOK, serve("", "").Code)
+
+	// broken config keeps the last one
+	writeWebFile(t, path, []byte("basic_auth_users: ["))
+	assert.Equal(t, http.StatusOK, serve("", "").Code)
+}
+
+func Test_webConfigLoader_tls(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey, caPEM, _ := genCert(t, "ca", nil, nil)
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	serverCert, _, certPEM, keyPEM := genCert(t, "server1", ca, caKey)
+	writeWebFile(t, certFile, certPEM)
+	writeWebFile(t, keyFile, keyPEM)
+	writeWebFile(t, filepath.Join(dir, "ca.crt"), caPEM)
+	_, _, clientCertPEM, clientKeyPEM := genCert(t, "client", ca, caKey)
+	clientCert, err := tls.X509KeyPair(clientCertPEM, clientKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "web.yml")
+	writeWebFile(t, path, []byte(`tls_server_config:
+  cert_file: server.crt
+  key_file: server.key
+  client_auth_type: RequireAndVerifyClientCert
+  client_ca_file: ca.crt`))
+	loader, err := newWebConfigLoader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(loader.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	})))
+	srv.TLS = loader.serverTLSConfig()
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	// get returns certificate of server used by a new connection
+	get := func(certificates ...tls.Certificate) (*x509.Certificate, error) {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      roots,
+			ServerName:   "localhost",
+			Certificates: certificates,
+		}}}
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		return resp.TLS.PeerCertificates[0], nil
+	}
+
+	_, err = get()
+	assert.Error(t, err, "client certificate is required")
+	got, err := get(clientCert)
+	if assert.NoError(t, err) {
+		assert.Equal(t, serverCert.SerialNumber, got.SerialNumber)
+	}
+
+	// rotated certificate is used by new connections
+	rotated, _, certPEM, keyPEM := genCert(t, "server2", ca, caKey)
+	writeWebFile(t, keyFile, keyPEM)
+	writeWebFile(t, certFile, certPEM)
+	got, err = get(clientCert)
+	if assert.NoError(t, err) {
+		assert.Equal(t, rotated.SerialNumber, got.SerialNumber)
+	}
+
+	// broken certificate keeps the last one
+	writeWebFile(t, certFile, []byte("broken"))
+	got, err = get(clientCert)
+	if assert.NoError(t, err) {
+		assert.Equal(t, rotated.SerialNumber, got.SerialNumber)
+	}
+}
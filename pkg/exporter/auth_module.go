@@ -0,0 +1,108 @@
+// Copyright © 2021 Bin Liu <bin.liu@enmotech.com>
+
+package exporter
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+const authModuleUserPass = "userpass"
+
+// AuthModule credentials and connection options used to scrape a probe target
+type AuthModule struct {
+	Type     string            `yaml:"type"`
+	UserPass UserPass          `yaml:"userpass,omitempty"`
+	Options  map[string]string `yaml:"options,omitempty"` // extra connection options, like sslmode dbname
+}
+
+// UserPass username and password of an auth module
+type UserPass struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+type authConfig struct {
+	AuthModules map[string]*AuthModule `yaml:"auth_modules"`
+}
+
+// LoadAuthModules load named auth modules from config file
+func LoadAuthModules(configPath string) (map[string]*AuthModule, error) {
+	content, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("fail reading auth config file %s: %w", configPath, err)
+	}
+	return ParseAuthModules(content)
+}
+
+// ParseAuthModules turn auth config content into AuthModule map
+func ParseAuthModules(content []byte) (map[string]*AuthModule, error) {
+	config := &authConfig{}
+	if err := yaml.UnmarshalStrict(content, config); err != nil {
+		return nil, fmt.Errorf("malformed auth config: %w", err)
+	}
+	for name, module := range config.AuthModules {
+		if module == nil {
+			return nil, fmt.Errorf("auth module %s is empty", name)
+		}
+		if module.Type == "" {
+			module.Type = authModuleUserPass
+		}
+		if module.Type != authModuleUserPass {
+			return nil, fmt.Errorf("auth module %s have unsupported type: %s", name, module.Type)
+		}
+	}
+	return config.AuthModules, nil
+}
+
+// ConfigureTarget build the dsn of a probe target. target is host[:port] or a dsn without password,
+// credentials and options always come from the auth module, a requester could not weaken them like sslmode
+func (a *AuthModule) ConfigureTarget(target string) (string, error) {
+	settings, err := parseTarget(target)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := settings["password"]; ok {
+		return "", fmt.Errorf("target must not contain password, use auth module instead")
+	}
+	if a == nil {
+		return genDSNString(settings), nil
+	}
+	for k, v := range a.Options {
+		if k == "dbname" {
+			k = "database"
+		}
+		settings[k] = v
+	}
+	if a.UserPass.Username != "" {
+		settings["user"] = a.UserPass.Username
+	}
+	if a.UserPass.Password != "" {
+		settings["password"] = a.UserPass.Password
+	}
+	return genDSNString(settings), nil
+}
+
+func parseTarget(target string) (map[string]string, error) {
+	target = strings.TrimSpace(target)
+	if target == "" {
+		return nil, fmt.Errorf("target is empty")
+	}
+	if strings.Contains(target, "://") || strings.Contains(target, "=") {
+		return parseDsn(target)
+	}
+	settings := make(map[string]string)
+	if isIPOnly(target) {
+		settings["host"] = strings.Trim(target, "[]")
+		return settings, nil
+	}
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target %s: %w", target, err)
+	}
+	settings["host"], settings["port"] = host, port
+	return settings, nil
+}
@@ -17,6 +17,9 @@ const (
 	DURATION     = "DURATION"
 )
 
+// histogramSuffixes companion columns required by a HISTOGRAM column
+var histogramSuffixes = []string{"_bucket", "_sum", "_count"}
+
 var ColumnUsage = map[string]bool{
 	DISCARD:      true,
 	LABEL:        true,
@@ -32,6 +35,7 @@ type Column struct {
 	Desc           string               `yaml:"description,omitempty"`
 	Usage          string               `yaml:"usage,omitempty"`
 	Rename         string               `yaml:"rename,omitempty"`
+	Mapping        map[string]float64   `yaml:"mapping,omitempty"` // MAPPEDMETRIC: column text value to metric value, NULL is NaN
 	DisCard        bool                 `yaml:"-"`
 	Histogram      bool                 `yaml:"-"` // Should metric be treated as a histogram?
 	PrometheusDesc *prometheus.Desc     `yaml:"-"`
@@ -41,3 +45,11 @@ type Column struct {
 func (c *Column) String() string {
 	return fmt.Sprintf("%-8s %-30s %s", c.Usage, c.Name, c.Desc)
 }
+
+// ExportName returns the name used in metric and label names, rename takes precedence over the column name
+func (c *Column) ExportName() string {
+	if c.Rename != "" {
+		return c.Rename
+	}
+	return c.Name
+}
@@ -4,6 +4,8 @@ package exporter
 
 import (
 	"fmt"
+	"math"
+	"reflect"
 	"testing"
 )
 
@@ -150,3 +152,81 @@ func TestParseConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestParseConfig_mapping(t *testing.T) {
+	content := []byte(`pg_sync_standby:
+  query:
+  - sql: SELECT application_name, sync_state FROM pg_stat_replication
+  metrics:
+  - name: application_name
+    usage: LABEL
+  - name: sync_state
+    usage: MAPPEDMETRIC
+    mapping:
+      Async: 0
+      Sync: 1
+      Potential: 2
+      Quorum: 3`)
+	queries, err := ParseConfig(content, "")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	col := queries["pg_sync_standby"].Columns["sync_state"]
+	if col == nil {
+		t.Fatal("column sync_state not found")
+	}
+	want := map[string]float64{"Async": 0, "Sync": 1, "Potential": 2, "Quorum": 3}
+	if !reflect.DeepEqual(want, col.Mapping) {
+		t.Errorf("Column.Mapping = %v, want %v", col.Mapping, want)
+	}
+
+	// every value would be unmapped, rejected at load
+	_, err = ParseConfig([]byte(`pg_sync_standby:
+  query:
+  - sql: SELECT application_name, sync_state FROM pg_stat_replication
+  metrics:
+  - name: application_name
+    usage: LABEL
+  - name: sync_state
+    usage: MAPPEDMETRIC`), "")
+	if err == nil {
+		t.Error("ParseConfig() of MAPPEDMETRIC without mapping should fail")
+	}
+}
+
+func TestParseConfig_ttl(t *testing.T) {
+	content := []byte(`pg_never:
+  ttl: -1
+  query:
+  - sql: SELECT 1 AS value
+  metrics:
+  - name: value
+    usage: GAUGE
+pg_forever:
+  ttl: .inf
+  query:
+  - sql: SELECT 1 AS value
+  metrics:
+  - name: value
+    usage: GAUGE
+pg_default:
+  query:
+  - sql: SELECT 1 AS value
+  metrics:
+  - name: value
+    usage: GAUGE`)
+	queries, err := ParseConfig(content, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl := queries["pg_never"].Queries[0].TTL; ttl != -1 {
+		t.Errorf("pg_never ttl = %v, want -1", ttl)
+	}
+	if ttl := queries["pg_forever"].Queries[0].TTL; !math.IsInf(ttl, 1) {
+		t.Errorf("pg_forever ttl = %v, want +Inf", ttl)
+	}
+	if ttl := queries["pg_default"].Queries[0].TTL; ttl != defaultTTL {
+		t.Errorf("pg_default ttl = %v, want %v", ttl, defaultTTL)
+	}
+}
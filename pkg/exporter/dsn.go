@@ -14,21 +14,26 @@ import (
 func parseDsn(dsn string) (map[string]string, error) {
 	connStringSettings := make(map[string]string) // nolint
 	var err error
-	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+	// dsn is not part of errors, it may hold password
+	if isURLDSN(dsn) {
 		connStringSettings, err = parseURLSettings(dsn)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse as URL %s err %s", dsn, err)
+			return nil, fmt.Errorf("failed to parse as URL: %s", err)
 		}
 	} else {
 		connStringSettings, err = parseDSNSettings(dsn)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse as DSN %s err %s", dsn, err)
+			return nil, fmt.Errorf("failed to parse as DSN: %s", err)
 		}
 	}
 	return connStringSettings, nil
 
 }
 
+func isURLDSN(dsn string) bool {
+	return strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://")
+}
+
 var asciiSpace = [256]uint8{'\t': 1, '\n': 1, '\v': 1, '\f': 1, '\r': 1, ' ': 1}
 
 func parseDSNSettings(s string) (map[string]string, error) {
@@ -103,6 +108,32 @@ func parseDSNSettings(s string) (map[string]string, error) {
 	return settings, nil
 }
 
+// dsnValueLen length of the value s starts with in key=value dsn, quotes and escapes included
+func dsnValueLen(s string) int {
+	if len(s) == 0 {
+		return 0
+	}
+	if s[0] != '\'' {
+		end := 0
+		for ; end < len(s) && asciiSpace[s[end]] != 1; end++ {
+			if s[end] == '\\' && end+1 < len(s) {
+				end++
+			}
+		}
+		return end
+	}
+	end := 1
+	for ; end < len(s) && s[end] != '\''; end++ {
+		if s[end] == '\\' {
+			end++
+		}
+	}
+	if end >= len(s) {
+		return len(s)
+	}
+	return end + 1
+}
+
 func isIPOnly(host string) bool {
 	return net.ParseIP(strings.Trim(host, "[]")) != nil || !strings.Contains(host, ":")
 }
@@ -110,14 +141,18 @@ func isIPOnly(host string) bool {
 func parseURLSettings(connString string) (map[string]string, error) {
 	settings := make(map[string]string)
 
-	url, err := url.Parse(connString)
+	u, err := url.Parse(connString)
 	if err != nil {
+		// url.Error quotes the whole url
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
 		return nil, err
 	}
 
-	if url.User != nil {
-		settings["user"] = url.User.Username()
-		if password, present := url.User.Password(); present {
+	if u.User != nil {
+		settings["user"] = u.User.Username()
+		if password, present := u.User.Password(); present {
 			settings["password"] = password
 		}
 	}
@@ -125,7 +160,7 @@ func parseURLSettings(connString string) (map[string]string, error) {
 	// Handle multiple host:port's in url.Host by splitting them into host,host,host and port,port,port.
 	var hosts []string
 	var ports []string
-	for _, host := range strings.Split(url.Host, ",") {
+	for _, host := range strings.Split(u.Host, ",") {
 		if host == "" {
 			continue
 		}
@@ -147,12 +182,12 @@ func parseURLSettings(connString string) (map[string]string, error) {
 		settings["port"] = strings.Join(ports, ",")
 	}
 
-	database := strings.TrimLeft(url.Path, "/")
+	database := strings.TrimLeft(u.Path, "/")
 	if database != "" {
 		settings["database"] = database
 	}
 
-	for k, v := range url.Query() {
+	for k, v := range u.Query() {
 		settings[k] = v[0]
 	}
 
@@ -162,8 +197,19 @@ func parseURLSettings(connString string) (map[string]string, error) {
 func genDSNString(connStringSettings map[string]string) string {
 	var kvs []string
 	for k, v := range connStringSettings {
-		kvs = append(kvs, fmt.Sprintf("%s=%v", k, v))
+		kvs = append(kvs, fmt.Sprintf("%s=%s", k, quoteDSNValue(v)))
 	}
 	sort.Strings(kvs) // Makes testing easier (not a performance concern)
 	return strings.Join(kvs, " ")
 }
+
+var dsnValueEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+// quoteDSNValue quote value of key=value dsn if it is empty or holds space, quote or backslash,
+// like paths of certificates. parseDSNSettings turns it back
+func quoteDSNValue(v string) string {
+	if v != "" && !strings.ContainsAny(v, " \t\n\r\v\f'\\") {
+		return v
+	}
+	return "'" + dsnValueEscaper.Replace(v) + "'"
+}
@@ -2,6 +2,11 @@
 
 package exporter
 
+import (
+	"errors"
+	"fmt"
+)
+
 type ErrorConnectToServer struct {
 	Msg string
 }
@@ -10,3 +15,27 @@ type ErrorConnectToServer struct {
 func (e *ErrorConnectToServer) Error() string {
 	return e.Msg
 }
+
+// reason label of exporter_query_truncated_total
+const (
+	truncatedRows   = "rows"   // more rows than maxRows returned
+	truncatedSeries = "series" // more metrics than maxSeries produced
+)
+
+// ErrorTruncated query result exceeded maxRows or maxSeries, metrics collected before the limit are kept
+type ErrorTruncated struct {
+	Query string
+	Limit string
+	Max   int
+}
+
+// Error returns error
+func (e *ErrorTruncated) Error() string {
+	return fmt.Sprintf("Collect Metric [%s] truncated at %d %s", e.Query, e.Max, e.Limit)
+}
+
+// isTruncated true if err is an ErrorTruncated
+func isTruncated(err error) bool {
+	var truncated *ErrorTruncated
+	return errors.As(err, &truncated)
+}
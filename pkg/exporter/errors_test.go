@@ -3,6 +3,7 @@
 package exporter
 
 import (
+	"fmt"
 	"testing"
 )
 
@@ -32,3 +33,16 @@ func TestErrorConnectToServer_Error(t *testing.T) {
 		})
 	}
 }
+
+func TestErrorTruncated_Error(t *testing.T) {
+	err := fmt.Errorf("wrap: %w", &ErrorTruncated{Query: "pg_stat_activity", Limit: truncatedRows, Max: 100})
+	if !isTruncated(err) {
+		t.Errorf("isTruncated() = false, want true")
+	}
+	if want := "wrap: Collect Metric [pg_stat_activity] truncated at 100 rows"; err.Error() != want {
+		t.Errorf("Error() = %v, want %v", err.Error(), want)
+	}
+	if isTruncated(fmt.Errorf("pq: relation does not exist")) {
+		t.Errorf("isTruncated() = true, want false")
+	}
+}
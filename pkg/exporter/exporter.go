@@ -3,29 +3,34 @@
 package exporter
 
 import (
+	"context"
 	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Exporter struct {
 	dsn                    []string
-	configPath             string   // config file path /directory
-	disableCache           bool     // always execute query when been scrapped
-	autoDiscovery          bool     // discovery other database on primary server
-	failFast               bool     // fail fast instead fof waiting during start-up ?
-	excludedDatabases      []string // excluded database for auto discovery
+	targetSources          []TargetSource // targets resolved on every scrape, like credential files
+	configPath             string         // config file path /directory
+	disableCache           bool           // always execute query when been scrapped
+	autoDiscovery          bool           // discovery other database on primary server
+	failFast               bool           // fail fast instead fof waiting during start-up ?
+	excludedDatabases      []string       // excluded database for auto discovery
 	disableSettingsMetrics bool
 	tags                   []string
 	namespace              string
+	namespaceQueries       bool // prefix query metrics with namespace
 	servers                *Servers
+	probeServers           *Servers                  // servers of /probe targets
 	allMetricMap           map[string]*QueryInstance // 全部采集指标 不判断Public为true
 	priMetricMap           map[string]*QueryInstance // 私有采集指标 autoDiscover下公用指标,只采集一次
-	collStatus             map[string]bool
-	constantLabels         prometheus.Labels // 用户定义标签
+	constantLabels         prometheus.Labels         // 用户定义标签
 
 	lock sync.RWMutex // export lock
 
@@ -40,15 +45,23 @@ type Exporter struct {
 	scrapeDuration   prometheus.Gauge     // exporter level: seconds spend on scrape
 	scrapeTotalCount prometheus.Counter   // exporter level: total scrape count of this server
 	scrapeErrorCount prometheus.Counter   // exporter level: error scrape count
+	queriesInFlight  prometheus.GaugeFunc // exporter level: queries running on databases
+	queriesWaiting   prometheus.GaugeFunc // exporter level: queries waiting for query limit
 
-	timeToString bool
-	parallel     int
+	timeToString   bool
+	asyncCollect   bool // run queries in background, scrape only serve latest results
+	parallel       int
+	classLimits    map[string]int // max concurrent queries of each concurrency class
+	targetParallel int            // number of targets scraped concurrently
+	scrapeBudget   time.Duration  // max duration of a server scrape
+	queryLimit     *queryLimit    // limit of concurrent queries of all servers, size is parallel
+	classLimit     *classLimit    // limit of concurrent queries of each class of all servers
 }
 
 // NewExporter New Exporter
 func NewExporter(opts ...Opt) (e *Exporter, err error) {
 	e = &Exporter{
-		allMetricMap: defaultMonList, // default metric
+		allMetricMap: cloneQueries(defaultMonList), // default metric, every exporter owns a copy so reload do not share state
 		priMetricMap: map[string]*QueryInstance{},
 		parallel:     1,
 		exportInit:   time.Now(),
@@ -56,21 +69,38 @@ func NewExporter(opts ...Opt) (e *Exporter, err error) {
 	for _, opt := range opts {
 		opt(e)
 	}
+	if e.parallel <= 0 {
+		e.parallel = 1
+	}
+	e.queryLimit = newQueryLimit(e.parallel)
+	e.classLimit = newClassLimit(e.classLimits)
 
 	e.initDefaultMetric()
 
 	if err := e.loadConfig(); err != nil {
 		return nil, err
 	}
+	e.setupQueryNamespace()
+	if err := e.checkQueryMetricNames(); err != nil {
+		return nil, err
+	}
 	e.setupInternalMetrics()
 	e.setupServers()
 
-	if e.parallel == 0 {
-		e.parallel = 1
+	if e.targetParallel <= 0 {
+		e.targetParallel = 1
 	}
 	return e, nil
 }
 
+func cloneQueries(queries map[string]*QueryInstance) map[string]*QueryInstance {
+	result := make(map[string]*QueryInstance, len(queries))
+	for name, q := range queries {
+		result[name] = q.Clone()
+	}
+	return result
+}
+
 // initDefaultMetric init default metric
 func (e *Exporter) initDefaultMetric() {
 	for _, q := range e.allMetricMap {
@@ -118,14 +148,36 @@ func (e *Exporter) loadConfig() error {
 	return nil
 }
 
+// setupQueryNamespace set metric namespace of every query. only query with namespace override are prefixed
+// unless namespaceQueries is enabled
+func (e *Exporter) setupQueryNamespace() {
+	namespace := ""
+	if e.namespaceQueries {
+		namespace = e.namespace
+	}
+	for _, q := range e.allMetricMap {
+		q.SetNamespace(namespace)
+	}
+}
+
 func (e *Exporter) setupServers() {
-	e.servers = NewServers(ServerWithLabels(e.constantLabels),
+	opts := []ServerOpt{ServerWithLabels(e.constantLabels),
 		ServerWithNamespace(e.namespace),
 		ServerWithDisableSettingsMetrics(e.disableSettingsMetrics),
 		ServerWithDisableCache(e.disableCache),
 		ServerWithTimeToString(e.timeToString),
 		ServerWithParallel(e.parallel),
-	)
+		ServerWithAsyncCollect(e.asyncCollect),
+		ServerWithTags(e.tags),
+		ServerWithClassLimit(e.classLimit),
+		ServerWithScrapeBudget(e.scrapeBudget),
+		ServerWithQueryLimit(e.queryLimit),
+	}
+	e.servers = NewServers(opts...)
+	// probe target always collect all metrics. probes run queries on request, a background scheduler
+	// would keep querying the target after the last probe
+	e.probeServers = NewServers(append(opts, ServerWithQueryInstanceMap(e.allMetricMap), ServerWithAsyncCollect(false))...)
+	e.probeServers.idleTimeout, e.probeServers.maxServers = probeIdleTimeout, probeMaxServers
 }
 
 // Describe implement prometheus.Collector
@@ -148,44 +200,39 @@ func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 
 // Collect
 // Collect->
-// 		scrape->
-//			-> discoverDatabaseDSNs
-//			-> scrapeDSN
-//				-> GetServer
-// 				-> checkMapVersions
+//
+//	scrape->
+//		-> discoverDatabaseDSNs
+//		-> scrapeDSN
+//			-> GetServer
+//			-> checkMapVersions
 func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
-	e.scrape(ch)
+	e.CollectContext(context.Background(), ch)
+}
+
+// CollectContext collect metrics, targets not finished before ctx done are reported as down
+func (e *Exporter) CollectContext(ctx context.Context, ch chan<- prometheus.Metric) {
+	e.scrape(ctx, ch)
 	e.collectServerMetrics()
 	e.collectInternalMetrics(ch)
 }
 
-func (e *Exporter) scrape(ch chan<- prometheus.Metric) {
-	e.lock.Lock()
-	defer e.lock.Unlock()
+func (e *Exporter) scrape(ctx context.Context, ch chan<- prometheus.Metric) {
 	// 设置采集开始时间
-	e.scrapeBegin = time.Now()
+	scrapeBegin := time.Now()
 
-	dsnList := e.dsn
+	dsnList := e.targetDSNs()
 	if e.autoDiscovery {
-		dsnList = e.discoverDatabaseDSNs()
+		dsnList = e.discoverDatabaseDSNs(ctx, dsnList)
 	}
 
-	var errorsCount int
-	var connectionErrorsCount int
-	// 重置采集状态
-	e.collStatus = map[string]bool{}
-	for _, dsn := range dsnList {
-		// log.Debugf(dsn)
-		if err := e.scrapeDSN(ch, dsn); err != nil {
-			errorsCount++
-
-			log.Errorf(err.Error())
-
-			if _, ok := err.(*ErrorConnectToServer); ok {
-				connectionErrorsCount++
-			}
-		}
-	}
+	errorsCount := e.scrapeTargets(ctx, ch, dsnList)
+	// probe targets idle for long are closed even if no probe comes anymore
+	e.probeServers.evict()
+	// concurrent scrapes run together, only the scrape time is shared
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.scrapeBegin = scrapeBegin
 	// 设置结束开始时间
 	e.scrapeDone = time.Now()
 	// 最后采集时间
@@ -198,10 +245,100 @@ func (e *Exporter) scrape(ch chan<- prometheus.Metric) {
 	e.exporterUp.Set(1)
 	log.Debugf("the errorsCount %v ", errorsCount)
 }
+
+// scrapeTargets scrape targets concurrently, at most targetParallel at a time.
+// metrics of each target are buffered and sent only when the target finished in time,
+// a late target is reported as up 0 and its result dropped
+func (e *Exporter) scrapeTargets(ctx context.Context, ch chan<- prometheus.Metric, dsnList []string) int {
+	owners := fingerprintOwners(dsnList)
+	workers := make(chan struct{}, e.targetParallel)
+	var (
+		wg          sync.WaitGroup
+		errorsCount int64
+	)
+	for i, dsn := range dsnList {
+		wg.Add(1)
+		go func(dsn string, owner bool) {
+			defer wg.Done()
+			resultCh := make(chan targetResult, 1)
+			go func() {
+				select {
+				case workers <- struct{}{}:
+				case <-ctx.Done():
+					resultCh <- targetResult{err: ctx.Err()}
+					return
+				}
+				// worker is released when scrape actually finished, even if the target is late
+				defer func() { <-workers }()
+				resultCh <- e.scrapeTarget(ctx, dsn, owner)
+			}()
+
+			var result targetResult
+			select {
+			case result = <-resultCh:
+			case <-ctx.Done():
+				result = targetResult{err: fmt.Errorf("scrape target (%s) timeout: %s", ShadowDSN(dsn), ctx.Err())}
+			}
+			if result.err != nil {
+				atomic.AddInt64(&errorsCount, 1)
+				log.Error(result.err)
+			}
+			if result.metrics == nil {
+				// 只有负责公共指标的dsn上报up, 避免同一个server重复
+				if owner {
+					if m := e.targetDownMetric(dsn); m != nil {
+						ch <- m
+					}
+				}
+				return
+			}
+			for _, m := range result.metrics {
+				ch <- m
+			}
+		}(dsn, owners[i])
+	}
+	wg.Wait()
+	return int(errorsCount)
+}
+
+type targetResult struct {
+	metrics []prometheus.Metric // nil when connect failed
+	err     error
+}
+
+// scrapeTarget scrape one target into buffer
+func (e *Exporter) scrapeTarget(ctx context.Context, dsn string, owner bool) targetResult {
+	metrics, err := bufferMetrics(func(ch chan<- prometheus.Metric) error {
+		return e.scrapeDSN(ctx, ch, dsn, owner)
+	})
+	if _, ok := err.(*ErrorConnectToServer); ok {
+		return targetResult{err: err}
+	}
+	return targetResult{metrics: metrics, err: err}
+}
+
+// fingerprintOwners the first dsn of every ip+port collects public and internal metrics,
+// decided before scraping so concurrent targets do not race for it
+func fingerprintOwners(dsnList []string) []bool {
+	owners := make([]bool, len(dsnList))
+	seen := make(map[string]bool, len(dsnList))
+	for i, dsn := range dsnList {
+		fingerprint, err := parseFingerprint(dsn)
+		if err != nil {
+			fingerprint = dsn
+		}
+		if !seen[fingerprint] {
+			seen[fingerprint] = true
+			owners[i] = true
+		}
+	}
+	return owners
+}
+
 func (e *Exporter) collectServerMetrics() {
-	for _, s := range e.servers.servers {
-		e.scrapeTotalCount.Add(float64(s.ScrapeTotalCount))
-		e.scrapeErrorCount.Add(float64(s.ScrapeErrorCount))
+	for _, s := range e.servers.list() {
+		e.scrapeTotalCount.Add(float64(atomic.LoadInt64(&s.ScrapeTotalCount)))
+		e.scrapeErrorCount.Add(float64(atomic.LoadInt64(&s.ScrapeErrorCount)))
 	}
 }
 func (e *Exporter) collectInternalMetrics(ch chan<- prometheus.Metric) {
@@ -212,23 +349,42 @@ func (e *Exporter) collectInternalMetrics(ch chan<- prometheus.Metric) {
 	ch <- e.scrapeTotalCount
 	ch <- e.scrapeErrorCount
 	ch <- e.scrapeDuration
+	ch <- e.queriesInFlight
+	ch <- e.queriesWaiting
+}
 
+// targetDSNs returns dsn of static targets and target sources.
+// servers of targets removed or whose credentials changed are closed
+func (e *Exporter) targetDSNs() []string {
+	dsnList := append([]string{}, e.dsn...)
+	for _, source := range e.targetSources {
+		dsns, err := source.DSNs()
+		if err != nil {
+			log.Errorf("fail resolving targets: %s", err)
+		}
+		dsnList = append(dsnList, dsns...)
+	}
+	if len(e.targetSources) > 0 {
+		e.servers.prune(dsnList)
+	}
+	return dsnList
 }
-func (e *Exporter) discoverDatabaseDSNs() []string {
+
+func (e *Exporter) discoverDatabaseDSNs(ctx context.Context, dsnList []string) []string {
 	result := []string{}
-	for _, dsn := range e.dsn {
+	for _, dsn := range dsnList {
 		parsedDSN, err := parseDsn(dsn)
 		if err != nil {
 			log.Errorf("Unable to parse DSN (%s): %v", ShadowDSN(dsn), err)
 			continue
 		}
-		server, err := e.servers.GetServer(dsn)
+		server, err := e.servers.GetServer(ctx, dsn)
 		if err != nil {
 			log.Errorf("Error opening connection to database (%s): %v", ShadowDSN(dsn), err)
 			continue
 		}
 
-		databaseNames, err := server.QueryDatabases()
+		databaseNames, err := server.QueryDatabases(ctx)
 		if err != nil {
 			log.Errorf("Error querying databases (%s): %v", ShadowDSN(dsn), err)
 			continue
@@ -244,25 +400,59 @@ func (e *Exporter) discoverDatabaseDSNs() []string {
 	}
 	return result
 }
-func (e *Exporter) scrapeDSN(ch chan<- prometheus.Metric, dsn string) error {
-	server, err := e.servers.GetServer(dsn)
+func (e *Exporter) scrapeDSN(ctx context.Context, ch chan<- prometheus.Metric, dsn string, owner bool) error {
+	server, err := e.servers.GetServer(ctx, dsn)
 
 	if err != nil {
 		return &ErrorConnectToServer{fmt.Sprintf("Error opening connection to database (%s): %s", ShadowDSN(dsn), err.Error())}
 	}
 
-	_, ok := e.collStatus[server.fingerprint]
 	// 如果同一个ip+端口采集过一次,说明公共指标已采集,不需要在采集了
-	if ok {
-		server.queryInstanceMap = e.priMetricMap
-		server.notCollInternalMetrics = true
+	if owner {
+		server.setQueryInstanceMap(e.allMetricMap, false)
 	} else {
-		server.queryInstanceMap = e.allMetricMap
-		defer func() { e.collStatus[server.fingerprint] = true }()
+		server.setQueryInstanceMap(e.priMetricMap, true)
 	}
 
-	return server.Scrape(ch)
+	return server.Scrape(ctx, ch)
 }
 func (e *Exporter) Close() {
 	e.servers.Close()
+	e.probeServers.Close()
+}
+
+// FlushCache drop cached query results on all servers, returns number of results dropped
+func (e *Exporter) FlushCache() int {
+	var n int
+	for _, servers := range []*Servers{e.servers, e.probeServers} {
+		for _, server := range servers.list() {
+			n += server.FlushCache()
+		}
+	}
+	return n
+}
+
+// ServerStatuses state of servers of configured targets, sorted by dsn
+func (e *Exporter) ServerStatuses() []ServerStatus {
+	servers := e.servers.list()
+	statuses := make([]ServerStatus, 0, len(servers))
+	for _, server := range servers {
+		statuses = append(statuses, server.Status())
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].DSN < statuses[j].DSN
+	})
+	return statuses
+}
+
+// ResetBreakers close circuit breakers of query on all servers, all queries if query is empty.
+// returns number of breakers reset
+func (e *Exporter) ResetBreakers(query string) int {
+	var n int
+	for _, servers := range []*Servers{e.servers, e.probeServers} {
+		for _, server := range servers.list() {
+			n += server.ResetBreaker(query)
+		}
+	}
+	return n
 }
@@ -3,8 +3,10 @@
 package exporter
 
 import (
+	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
 	"gopkg.in/yaml.v2"
+	"sort"
 	"strings"
 )
 
@@ -43,6 +45,85 @@ func (e *Exporter) setupInternalMetrics() {
 		Namespace: e.namespace, ConstLabels: e.constantLabels,
 		Subsystem: "exporter", Name: "last_scrape_time", Help: "seconds exporter spending on scrapping",
 	})
+	e.queriesInFlight = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: e.namespace, ConstLabels: e.constantLabels,
+		Subsystem: "exporter", Name: "queries_in_flight", Help: "number of queries running on databases",
+	}, func() float64 {
+		inFlight, _ := e.queryLimit.Stats()
+		return float64(inFlight)
+	})
+	e.queriesWaiting = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: e.namespace, ConstLabels: e.constantLabels,
+		Subsystem: "exporter", Name: "queries_waiting", Help: "number of queries waiting for --parallel limit",
+	}, func() float64 {
+		_, waiting := e.queryLimit.Stats()
+		return float64(waiting)
+	})
+}
+
+// targetDownMetric up metric of target which could not be connected
+func (e *Exporter) targetDownMetric(dsn string) prometheus.Metric {
+	fingerprint, err := parseFingerprint(dsn)
+	if err != nil {
+		return nil
+	}
+	labels := prometheus.Labels{serverLabelName: fingerprint}
+	for k, v := range e.constantLabels {
+		labels[k] = v
+	}
+	desc := prometheus.NewDesc(prometheus.BuildFQName(e.namespace, "", "up"),
+		"always be 1 if your could retrieve metrics", nil, labels)
+	return prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 0)
+}
+
+// checkQueryMetricNames make sure query metrics do not collide with built-in metrics,
+// nor with each other once namespace and rename are applied
+func (e *Exporter) checkQueryMetricNames() error {
+	reservedNames := map[string]bool{
+		prometheus.BuildFQName(e.namespace, "", "up"):          true,
+		prometheus.BuildFQName(e.namespace, "", "version"):     true,
+		prometheus.BuildFQName(e.namespace, "", "in_recovery"): true,
+	}
+	reservedPrefixes := []string{
+		prometheus.BuildFQName(e.namespace, "", "exporter_"),
+		prometheus.BuildFQName(e.namespace, "", "settings_"),
+	}
+	queryNames := make([]string, 0, len(e.allMetricMap))
+	for name := range e.allMetricMap {
+		queryNames = append(queryNames, name)
+	}
+	sort.Strings(queryNames)
+	owners := make(map[string]string) // final metric name -> query and column exposing it
+	for _, queryName := range queryNames {
+		q := e.allMetricMap[queryName]
+		for _, metricName := range q.MetricNames {
+			col := q.Columns[metricName]
+			name := q.MetricName(col)
+			names := []string{name}
+			if col.Histogram {
+				for _, suffix := range histogramSuffixes {
+					names = append(names, name+suffix)
+				}
+			}
+			owner := fmt.Sprintf("query %s column %s", q.Name, metricName)
+			for _, n := range names {
+				// a column listed twice in the same query is the same metric
+				if other, ok := owners[n]; ok && other != owner {
+					return fmt.Errorf("%s metric %s collides with %s", owner, n, other)
+				}
+				owners[n] = owner
+			}
+			if reservedNames[name] {
+				return fmt.Errorf("query %s metric %s collides with built-in metric", q.Name, name)
+			}
+			for _, prefix := range reservedPrefixes {
+				if strings.HasPrefix(name, prefix) {
+					return fmt.Errorf("query %s metric %s collides with built-in metrics %s*", q.Name, name, prefix)
+				}
+			}
+		}
+	}
+	return nil
 }
 
 // GetMetricsList Get Metrics List
@@ -4,6 +4,7 @@ package exporter
 
 import (
 	"strings"
+	"time"
 )
 
 // Opt ExporterOpt configures Exporter
@@ -16,6 +17,13 @@ func WithDNS(dsn []string) Opt {
 	}
 }
 
+// WithTargetSources add targets resolved on every scrape, like dsn with password from file
+func WithTargetSources(sources ...TargetSource) Opt {
+	return func(e *Exporter) {
+		e.targetSources = append(e.targetSources, sources...)
+	}
+}
+
 // WithConfig add config path to Exporter
 func WithConfig(configPath string) Opt {
 	return func(e *Exporter) {
@@ -58,6 +66,13 @@ func WithNamespace(namespace string) Opt {
 	}
 }
 
+// WithNamespaceQueries will prefix metrics of user-defined queries with the exporter namespace
+func WithNamespaceQueries(b bool) Opt {
+	return func(e *Exporter) {
+		e.namespaceQueries = b
+	}
+}
+
 // WithTags will register given tags to Exporter and all belonged servers
 func WithTags(tags string) Opt {
 	return func(e *Exporter) {
@@ -77,6 +92,34 @@ func WithParallel(i int) Opt {
 	}
 }
 
+// WithClassLimits set max concurrent queries of each concurrency class, like heavy=1,catalog=2
+func WithClassLimits(s string) Opt {
+	return func(e *Exporter) {
+		e.classLimits = parseClassLimits(s)
+	}
+}
+
+// WithScrapeBudget set max duration of a server scrape, queries could not fit the time left are skipped
+func WithScrapeBudget(d time.Duration) Opt {
+	return func(e *Exporter) {
+		e.scrapeBudget = d
+	}
+}
+
+// WithTargetParallel set number of targets scraped concurrently
+func WithTargetParallel(i int) Opt {
+	return func(e *Exporter) {
+		e.targetParallel = i
+	}
+}
+
+// WithAsyncCollect run queries in background on their ttl, scrape only serve the latest results
+func WithAsyncCollect(b bool) Opt {
+	return func(e *Exporter) {
+		e.asyncCollect = b
+	}
+}
+
 // WithAutoDiscovery configures exporter with excluded database
 func WithAutoDiscovery(flag bool) Opt {
 	return func(e *Exporter) {
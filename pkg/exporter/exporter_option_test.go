@@ -6,6 +6,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 )
 
 func TestExporter_Opt(t *testing.T) {
@@ -39,6 +40,10 @@ func TestExporter_Opt(t *testing.T) {
 		WithNamespace("a1")(exporter)
 		assert.Equal(t, "a1", exporter.namespace)
 	})
+	t.Run("WithNamespaceQueries", func(t *testing.T) {
+		WithNamespaceQueries(true)(exporter)
+		assert.Equal(t, true, exporter.namespaceQueries)
+	})
 	t.Run("WithTags", func(t *testing.T) {
 		label := "a1=1,a2=2"
 		WithTags(label)(exporter)
@@ -52,6 +57,27 @@ func TestExporter_Opt(t *testing.T) {
 		WithParallel(5)(exporter)
 		assert.Equal(t, 5, exporter.parallel)
 	})
+	t.Run("WithClassLimits", func(t *testing.T) {
+		WithClassLimits("heavy=1, catalog=2")(exporter)
+		assert.Equal(t, map[string]int{"heavy": 1, "catalog": 2}, exporter.classLimits)
+	})
+	t.Run("WithScrapeBudget", func(t *testing.T) {
+		WithScrapeBudget(5 * time.Second)(exporter)
+		assert.Equal(t, 5*time.Second, exporter.scrapeBudget)
+	})
+	t.Run("WithTargetSources", func(t *testing.T) {
+		source := staticTargets{"host=127.0.0.1"}
+		WithTargetSources(source)(exporter)
+		assert.Equal(t, []TargetSource{source}, exporter.targetSources)
+	})
+	t.Run("WithTargetParallel", func(t *testing.T) {
+		WithTargetParallel(4)(exporter)
+		assert.Equal(t, 4, exporter.targetParallel)
+	})
+	t.Run("WithAsyncCollect", func(t *testing.T) {
+		WithAsyncCollect(true)(exporter)
+		assert.Equal(t, true, exporter.asyncCollect)
+	})
 	t.Run("WithAutoDiscovery", func(t *testing.T) {
 		WithAutoDiscovery(false)(exporter)
 		assert.Equal(t, false, exporter.autoDiscovery)
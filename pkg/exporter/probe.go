@@ -0,0 +1,47 @@
+// Copyright © 2021 Bin Liu <bin.liu@enmotech.com>
+
+package exporter
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"time"
+)
+
+const (
+	probeIdleTimeout = 5 * time.Minute // connection of probe target is closed if not probed for this long
+	probeMaxServers  = 64              // max connected probe targets, the least recently probed are closed
+)
+
+// ProbeCollector collect all metrics of a single target, used by /probe
+type ProbeCollector struct {
+	ctx context.Context
+	e   *Exporter
+	dsn string
+}
+
+// NewProbeCollector create collector scraping dsn with the loaded queries, queries are canceled with ctx
+func (e *Exporter) NewProbeCollector(ctx context.Context, dsn string) *ProbeCollector {
+	return &ProbeCollector{ctx: ctx, e: e, dsn: dsn}
+}
+
+// Describe implement prometheus.Collector. metrics depend on target, so the collector is unchecked
+func (p *ProbeCollector) Describe(ch chan<- *prometheus.Desc) {
+}
+
+// Collect implement prometheus.Collector
+func (p *ProbeCollector) Collect(ch chan<- prometheus.Metric) {
+	server, err := p.e.probeServers.acquire(p.ctx, p.dsn)
+	defer p.e.probeServers.release(p.dsn)
+	if err != nil {
+		log.Errorf("Error opening connection to database (%s): %s", ShadowDSN(p.dsn), err)
+		if m := p.e.targetDownMetric(p.dsn); m != nil {
+			ch <- m
+		}
+		return
+	}
+	if err = server.Scrape(p.ctx, ch); err != nil {
+		log.Errorf("Error scraping target (%s): %s", ShadowDSN(p.dsn), err)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/blang/semver"
 	"github.com/prometheus/client_golang/prometheus"
 	"gopkg.in/yaml.v2"
+	"sort"
 	"strings"
 	// "html/template"
 	"text/template"
@@ -15,9 +16,11 @@ import (
 )
 
 const (
-	statusEnable   = "enable"
-	statusDisable  = "disable"
-	defaultVersion = ">=0.0.0"
+	statusEnable    = "enable"
+	statusDisable   = "disable"
+	defaultVersion  = ">=0.0.0"
+	defaultTTL      = 60  // cache ttl in seconds when ttl is not set
+	defaultPriority = 100 // priority of queries not set, 1 - 99 is reserved for user
 )
 
 var queryTemplate, _ = template.New("Query").Parse(`
@@ -35,6 +38,17 @@ var queryTemplate, _ = template.New("Query").Parse(`
 {{.MarshalYAML}}
 `)
 
+// checkEnableCache empty means follow the global cache setting
+func checkEnableCache(s string) (string, error) {
+	s = strings.ToLower(s)
+	switch s {
+	case statusEnable, statusDisable, "":
+		return s, nil
+	default:
+		return "", fmt.Errorf("no support enableCache %s", s)
+	}
+}
+
 func CheckStatus(s string) (string, error) {
 	s = strings.ToLower(s)
 	switch s {
@@ -49,21 +63,29 @@ func CheckStatus(s string) (string, error) {
 
 // QueryInstance hold the information of how to fetch metric and parse them
 type QueryInstance struct {
-	Name        string             `yaml:"name,omitempty"`    // actual query name, used as metric prefix
-	Desc        string             `yaml:"desc,omitempty"`    // description of this metric query
-	Queries     []*Query           `yaml:"query,omitempty"`   // 采集SQL
-	Metrics     []*Column          `yaml:"metrics,omitempty"` // metric definition list
-	Status      string             `yaml:"status,omitempty"`  // enable/disable status. For the entire collection of indicators 针对整个采集指标
-	EnableCache string             `yaml:"enableCache,omitempty"`
-	TTL         float64            `yaml:"ttl,omitempty"`      // caching ttl in seconds
-	Priority    int                `yaml:"priority,omitempty"` // 权重,暂时不用
-	Timeout     float64            `yaml:"timeout,omitempty"`  // query execution timeout in seconds
-	Path        string             `yaml:"-"`                  // where am I from ?
-	Columns     map[string]*Column `yaml:"-"`                  // column map
-	ColumnNames []string           `yaml:"-"`                  // column names in origin orders
-	LabelNames  []string           `yaml:"-"`                  // column (name) that used as label, sequences matters
-	MetricNames []string           `yaml:"-"`                  // column (name) that used as metric
-	Public      bool               `yaml:"public,omitempty"`   // autoDiscover下公用指标,只采集一次
+	Name         string             `yaml:"name,omitempty"`         // actual query name, used as metric prefix
+	Desc         string             `yaml:"desc,omitempty"`         // description of this metric query
+	Queries      []*Query           `yaml:"query,omitempty"`        // 采集SQL
+	Metrics      []*Column          `yaml:"metrics,omitempty"`      // metric definition list
+	Status       string             `yaml:"status,omitempty"`       // enable/disable status. For the entire collection of indicators 针对整个采集指标
+	EnableCache  string             `yaml:"enableCache,omitempty"`  // enable/disable cache, overwrite --disable-cache. empty follows it
+	TTL          float64            `yaml:"ttl,omitempty"`          // caching ttl in seconds, <0 never cache, 0 default 60, .inf cache forever
+	StaleOnError float64            `yaml:"staleOnError,omitempty"` // seconds the last good result is served after a failure 查询失败时继续使用上次结果的秒数
+	Priority     int                `yaml:"priority,omitempty"`     // 权重,smaller run first. execution order of queries
+	Class        string             `yaml:"class,omitempty"`        // concurrency class, concurrent queries of a class are limited by --query-class-limits
+	Weight       int                `yaml:"weight,omitempty"`       // share of --parallel taken while running, default 1
+	MaxRows      int                `yaml:"maxRows,omitempty"`      // rows read at most, rest are dropped. 0 unlimited
+	MaxSeries    int                `yaml:"maxSeries,omitempty"`    // metrics produced at most, rest are dropped. 0 unlimited
+	Tags         []string           `yaml:"tags,omitempty"`         // default tags of queries
+	Timeout      float64            `yaml:"timeout,omitempty"`      // query execution timeout in seconds
+	Path         string             `yaml:"-"`                      // where am I from ?
+	Columns      map[string]*Column `yaml:"-"`                      // column map
+	ColumnNames  []string           `yaml:"-"`                      // column names in origin orders
+	LabelNames   []string           `yaml:"-"`                      // column (name) that used as label, sequences matters
+	MetricNames  []string           `yaml:"-"`                      // column (name) that used as metric
+	Public       bool               `yaml:"public,omitempty"`       // autoDiscover下公用指标,只采集一次
+	Namespace    string             `yaml:"namespace,omitempty"`    // metric namespace of this query, overwrite exporter namespace
+	namespace    string             // effective metric namespace, set by exporter
 	// Private     bool               `yaml:"ttl,omitempty"`
 }
 
@@ -73,18 +95,66 @@ type Query struct {
 	SQL          string       `yaml:"sql,omitempty"`     // actual query sql 查询sql
 	Version      string       `yaml:"version,omitempty"` // Check supported version 查询支持版本
 	versionRange semver.Range `yaml:"-"`                 // semver.Range
-	Tags         []string     `yaml:"tags,omitempty"`    // tags are used for execution control
+	Tags         []string     `yaml:"tags,omitempty"`    // tags are used for execution control, tag start with ! must not present on server
 	Timeout      float64      `yaml:"timeout,omitempty"` // query execution timeout in seconds
-	TTL          float64      `yaml:"ttl,omitempty"`     // caching ttl in seconds
+	TTL          float64      `yaml:"ttl,omitempty"`     // caching ttl in seconds, <0 never cache, .inf cache forever
 	Status       string       `yaml:"status,omitempty"`  // enable/disable status. 状态是否开启,针对特定版本.
 	EnableCache  string       `yaml:"enableCache,omitempty"`
-	DbRole       string       `yaml:"dbRole"` // only primary database collector. default false
+	StaleOnError float64      `yaml:"staleOnError,omitempty"` // seconds the last good result is served after a failure
+	MaxRows      int          `yaml:"maxRows,omitempty"`      // rows read at most, 0 unlimited
+	MaxSeries    int          `yaml:"maxSeries,omitempty"`    // metrics produced at most, 0 unlimited
+	DbRole       string       `yaml:"dbRole"`                 // only primary database collector. default false
 }
 
 // TimeoutDuration Get timeout settings
 func (q *Query) TimeoutDuration() time.Duration {
 	return time.Duration(float64(time.Second) * q.Timeout)
 }
+
+// MatchTags true if server tags satisfy all tags of query. tag start with ! must not present on server
+func (q *Query) MatchTags(serverTags []string) bool {
+	for _, tag := range q.Tags {
+		if strings.HasPrefix(tag, "!") {
+			if containsTag(serverTags, tag[1:]) {
+				return false
+			}
+		} else if !containsTag(serverTags, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func checkTags(tags []string) error {
+	for _, tag := range tags {
+		if strings.TrimPrefix(tag, "!") == "" {
+			return fmt.Errorf("invalid tag %q", tag)
+		}
+	}
+	return nil
+}
+
+// CacheEnabled enableCache of query overwrite the global disableCache
+func (q *Query) CacheEnabled(disableCache bool) bool {
+	switch q.EnableCache {
+	case statusEnable:
+		return true
+	case statusDisable:
+		return false
+	default:
+		return !disableCache
+	}
+}
+
 func (q *Query) IsPrimary() bool {
 	if q.DbRole == "" {
 		return true
@@ -137,22 +207,62 @@ func (q *QueryInstance) Check() error {
 		q.Timeout = 0
 	}
 	if q.TTL == 0 {
-		q.TTL = 60
+		q.TTL = defaultTTL
+	}
+	if q.StaleOnError < 0 {
+		q.StaleOnError = 0
+	}
+	if q.Weight <= 0 {
+		q.Weight = 1
+	}
+	if q.MaxRows < 0 {
+		q.MaxRows = 0
+	}
+	if q.MaxSeries < 0 {
+		q.MaxSeries = 0
 	}
 	if status, err := CheckStatus(q.Status); err != nil {
 		return err
 	} else {
 		q.Status = status
 	}
+	if enableCache, err := checkEnableCache(q.EnableCache); err != nil {
+		return err
+	} else {
+		q.EnableCache = enableCache
+	}
+	if err := checkTags(q.Tags); err != nil {
+		return fmt.Errorf("query %s %s", q.Name, err)
+	}
 	// parse query column info
 	columns := make(map[string]*Column, len(q.Metrics))
 	for _, query := range q.Queries {
 		if query.Timeout == 0 {
 			query.Timeout = q.Timeout
 		}
+		if enableCache, err := checkEnableCache(query.EnableCache); err != nil {
+			return err
+		} else {
+			query.EnableCache = enableCache
+		}
 		if query.EnableCache == "" {
 			query.EnableCache = q.EnableCache
 		}
+		if query.StaleOnError <= 0 {
+			query.StaleOnError = q.StaleOnError
+		}
+		if query.MaxRows <= 0 {
+			query.MaxRows = q.MaxRows
+		}
+		if query.MaxSeries <= 0 {
+			query.MaxSeries = q.MaxSeries
+		}
+		if err := checkTags(query.Tags); err != nil {
+			return fmt.Errorf("query %s %s", q.Name, err)
+		}
+		if len(query.Tags) == 0 {
+			query.Tags = q.Tags
+		}
 		//  默认版本
 		if query.Version == "" {
 			query.Version = defaultVersion
@@ -191,6 +301,10 @@ func (q *QueryInstance) Check() error {
 			column.Histogram = true
 			metricColumns = append(metricColumns, column.Name)
 		case MappedMETRIC:
+			// every value would be unmapped at scrape time
+			if len(column.Mapping) == 0 {
+				return fmt.Errorf("column %s have usage %s without mapping", column.Name, MappedMETRIC)
+			}
 			metricColumns = append(metricColumns, column.Name)
 		case DURATION:
 			metricColumns = append(metricColumns, column.Name)
@@ -198,10 +312,58 @@ func (q *QueryInstance) Check() error {
 		allColumns = append(allColumns, column.Name)
 		columns[column.Name] = column
 	}
+	// histogram companion columns (<name>_bucket, <name>_sum, <name>_count) are consumed by
+	// the histogram itself, so they must not be exported again as unknown metrics
+	for _, column := range q.Metrics {
+		if !column.Histogram {
+			continue
+		}
+		for _, suffix := range histogramSuffixes {
+			companion := column.Name + suffix
+			if _, ok := columns[companion]; !ok {
+				columns[companion] = &Column{Name: companion, Usage: DISCARD, DisCard: true}
+			}
+		}
+	}
 	q.Columns, q.ColumnNames, q.LabelNames, q.MetricNames = columns, allColumns, labelColumns, metricColumns
 	return nil
 }
 
+// Clone returns a copy of query instance with its own queries and columns, call Check before use
+func (q *QueryInstance) Clone() *QueryInstance {
+	c := *q
+	c.Queries = make([]*Query, 0, len(q.Queries))
+	for _, query := range q.Queries {
+		queryCopy := *query
+		c.Queries = append(c.Queries, &queryCopy)
+	}
+	c.Metrics = make([]*Column, 0, len(q.Metrics))
+	for _, column := range q.Metrics {
+		columnCopy := *column
+		c.Metrics = append(c.Metrics, &columnCopy)
+	}
+	c.Columns, c.ColumnNames, c.LabelNames, c.MetricNames = nil, nil, nil, nil
+	return &c
+}
+
+// GetPriority returns priority of query, queries not set use defaultPriority
+func (q *QueryInstance) GetPriority() int {
+	if q.Priority == 0 {
+		return defaultPriority
+	}
+	return q.Priority
+}
+
+// sortQueries sort queries by priority, then by name
+func sortQueries(queries []*QueryInstance) {
+	sort.Slice(queries, func(i, j int) bool {
+		if pi, pj := queries[i].GetPriority(), queries[j].GetPriority(); pi != pj {
+			return pi < pj
+		}
+		return queries[i].Name < queries[j].Name
+	})
+}
+
 // GetQuerySQL Get query sql according to version
 func (q *QueryInstance) GetQuerySQL(ver semver.Version, isPrimary bool) *Query {
 	for _, query := range q.Queries {
@@ -211,38 +373,72 @@ func (q *QueryInstance) GetQuerySQL(ver semver.Version, isPrimary bool) *Query {
 	}
 	return nil
 }
+
+// GetTaggedQuerySQL Get query sql according to version and tags of server
+func (q *QueryInstance) GetTaggedQuerySQL(ver semver.Version, isPrimary bool, serverTags []string) *Query {
+	for _, query := range q.Queries {
+		if query.IsSQL(ver, isPrimary) && query.MatchTags(serverTags) {
+			return query
+		}
+	}
+	return nil
+}
 func (q *QueryInstance) IsEnableCache() bool {
 	return strings.EqualFold(q.EnableCache, statusEnable)
 }
 
 // GetColumn Get column information
 func (q *QueryInstance) GetColumn(colName string, serverLabels prometheus.Labels) *Column {
-	if col, ok := q.Columns[colName]; ok {
+	if column, ok := q.Columns[colName]; ok {
+		// copy, queries are shared by servers scraped concurrently
+		col := *column
 		switch col.Usage {
 		case LABEL, DISCARD:
 			col.DisCard = true
 		case GAUGE:
 			col.PrometheusType = prometheus.GaugeValue
-			col.PrometheusDesc = prometheus.NewDesc(fmt.Sprintf("%s_%s", q.Name, col.Name), col.Desc, q.LabelNames, serverLabels)
+			col.PrometheusDesc = prometheus.NewDesc(q.MetricName(&col), col.Desc, q.LabelList(), serverLabels)
 		case COUNTER:
 			col.PrometheusType = prometheus.CounterValue
-			col.PrometheusDesc = prometheus.NewDesc(fmt.Sprintf("%s_%s", q.Name, col.Name), col.Desc, q.LabelNames, serverLabels)
+			col.PrometheusDesc = prometheus.NewDesc(q.MetricName(&col), col.Desc, q.LabelList(), serverLabels)
 		case HISTOGRAM:
 			col.PrometheusType = prometheus.UntypedValue
-			col.PrometheusDesc = prometheus.NewDesc(fmt.Sprintf("%s_%s", q.Name, col.Name), col.Desc, q.LabelNames, serverLabels)
+			col.PrometheusDesc = prometheus.NewDesc(q.MetricName(&col), col.Desc, q.LabelList(), serverLabels)
 		case MappedMETRIC:
 			col.PrometheusType = prometheus.GaugeValue
-			col.PrometheusDesc = prometheus.NewDesc(fmt.Sprintf("%s_%s", q.Name, col.Name), col.Desc, q.LabelNames, serverLabels)
+			col.PrometheusDesc = prometheus.NewDesc(q.MetricName(&col), col.Desc, q.LabelList(), serverLabels)
 		case DURATION:
 			col.PrometheusType = prometheus.GaugeValue
-			col.PrometheusDesc = prometheus.NewDesc(fmt.Sprintf("%s_%s_milliseconds", q.Name, col.Name), col.Desc, q.LabelNames, serverLabels)
+			col.PrometheusDesc = prometheus.NewDesc(q.MetricName(&col), col.Desc, q.LabelList(), serverLabels)
 		}
 
-		return col
+		return &col
 	}
 	return nil
 }
 
+// SetNamespace set the effective metric namespace. The query namespace overwrite the given one
+func (q *QueryInstance) SetNamespace(namespace string) {
+	if q.Namespace != "" {
+		namespace = q.Namespace
+	}
+	q.namespace = namespace
+}
+
+// MetricPrefix returns the prefix of all metrics generated by this query
+func (q *QueryInstance) MetricPrefix() string {
+	return prometheus.BuildFQName(q.namespace, "", q.Name)
+}
+
+// MetricName returns the exposed metric name of a column, honoring rename and the DURATION unit suffix
+func (q *QueryInstance) MetricName(col *Column) string {
+	name := fmt.Sprintf("%s_%s", q.MetricPrefix(), col.ExportName())
+	if col.Usage == DURATION {
+		name += "_milliseconds"
+	}
+	return name
+}
+
 func (q *QueryInstance) Explain() string {
 	buf := new(bytes.Buffer)
 	err := queryTemplate.Execute(buf, q)
@@ -292,22 +488,14 @@ func (q *QueryInstance) MetricList() (res []string) {
 	res = make([]string, len(q.MetricNames))
 
 	for _, metricName := range q.MetricNames {
-		metricColumnName := q.Columns[metricName].Name
-		if q.Columns[metricName].Rename != "" {
-			metricColumnName = q.Columns[metricName].Rename
-		}
-		if sigLength := len(q.Name) + len(metricColumnName) + len(labelSignature) + 3; sigLength > maxSignatureLength {
+		if sigLength := len(q.MetricName(q.Columns[metricName])) + len(labelSignature) + 2; sigLength > maxSignatureLength {
 			maxSignatureLength = sigLength
 		}
 	}
 	templateString := fmt.Sprintf("%%-%ds %%-8s %%s", maxSignatureLength+1)
 	for i, metricName := range q.MetricNames {
 		column := q.Columns[metricName]
-		metricColumnName := q.Columns[metricName].Name
-		if q.Columns[metricName].Rename != "" {
-			metricColumnName = q.Columns[metricName].Rename
-		}
-		metricSignature := fmt.Sprintf("%s_%s{%s}", q.Name, metricColumnName, labelSignature)
+		metricSignature := fmt.Sprintf("%s{%s}", q.MetricName(column), labelSignature)
 		res[i] = fmt.Sprintf(templateString, metricSignature, column.Usage, column.Desc)
 	}
 
@@ -318,12 +506,7 @@ func (q *QueryInstance) MetricList() (res []string) {
 func (q *QueryInstance) LabelList() []string {
 	labelNames := make([]string, len(q.LabelNames))
 	for i, labelName := range q.LabelNames {
-		labelColumn := q.Columns[labelName]
-		if labelColumn.Rename != "" {
-			labelNames[i] = labelColumn.Rename
-		} else {
-			labelNames[i] = labelColumn.Name
-		}
+		labelNames[i] = q.Columns[labelName].ExportName()
 	}
 	return labelNames
 }
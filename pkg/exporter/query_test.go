@@ -91,9 +91,10 @@ func TestQueryInstance(t *testing.T) {
 				Usage: HISTOGRAM,
 			},
 			{
-				Name:  "col6",
-				Desc:  "col6",
-				Usage: MappedMETRIC,
+				Name:    "col6",
+				Desc:    "col6",
+				Usage:   MappedMETRIC,
+				Mapping: map[string]float64{"on": 1},
 			},
 			{
 				Name:  "col7",
@@ -129,6 +130,28 @@ func TestQueryInstance(t *testing.T) {
 		assert.Error(t, err)
 		queryInstance.Queries[0].Status = ""
 	})
+	t.Run("Check_EnableCache_err", func(t *testing.T) {
+		queryInstance.EnableCache = "other"
+		err := queryInstance.Check()
+		assert.Error(t, err)
+		queryInstance.EnableCache = ""
+	})
+	t.Run("Check_EnableCache_StaleOnError", func(t *testing.T) {
+		queryInstance.EnableCache = "Disable"
+		queryInstance.StaleOnError = 30
+		err := queryInstance.Check()
+		assert.NoError(t, err)
+		assert.Equal(t, statusDisable, queryInstance.Queries[0].EnableCache)
+		assert.Equal(t, float64(30), queryInstance.Queries[0].StaleOnError)
+		queryInstance.EnableCache, queryInstance.StaleOnError = "", 0
+		queryInstance.Queries[0].EnableCache, queryInstance.Queries[0].StaleOnError = "", 0
+	})
+	t.Run("Check_Tags_err", func(t *testing.T) {
+		queryInstance.Queries[0].Tags = []string{"!"}
+		err := queryInstance.Check()
+		assert.Error(t, err)
+		queryInstance.Queries[0].Tags = nil
+	})
 	t.Run("Check_Metric_Usage_err", func(t *testing.T) {
 		queryInstance.Metrics[0].Usage = "other"
 		err := queryInstance.Check()
@@ -225,6 +248,15 @@ func TestQueryInstance(t *testing.T) {
 		col11 := queryInstance.GetColumn("col11", nil)
 		assert.Nil(t, col11)
 	})
+	t.Run("Clone", func(t *testing.T) {
+		c := queryInstance.Clone()
+		assert.NoError(t, c.Check())
+		assert.Equal(t, queryInstance.MetricNames, c.MetricNames)
+		c.Queries[0].SQL = "select clone"
+		c.Metrics[0].Desc = "clone"
+		assert.NotEqual(t, "select clone", queryInstance.Queries[0].SQL)
+		assert.NotEqual(t, "clone", queryInstance.Metrics[0].Desc)
+	})
 	t.Run("Explain", func(t *testing.T) {
 		pgStatDatabase.Check()
 		fmt.Println(pgStatDatabase.Explain())
@@ -236,6 +268,15 @@ func TestQuery(t *testing.T) {
 		r := query.TimeoutDuration()
 		assert.Equal(t, time.Duration(float64(time.Second)*query.Timeout), r)
 	})
+	t.Run("CacheEnabled", func(t *testing.T) {
+		assert.Equal(t, true, query.CacheEnabled(false))
+		assert.Equal(t, false, query.CacheEnabled(true))
+		query.EnableCache = statusEnable
+		assert.Equal(t, true, query.CacheEnabled(true))
+		query.EnableCache = statusDisable
+		assert.Equal(t, false, query.CacheEnabled(false))
+		query.EnableCache = ""
+	})
 	t.Run("IsPrimary", func(t *testing.T) {
 		assert.Equal(t, true, query.IsPrimary())
 		query.DbRole = "primary"
@@ -249,3 +290,76 @@ func TestQuery(t *testing.T) {
 		assert.Equal(t, false, query.IsPrimary())
 	})
 }
+
+func TestQuery_MatchTags(t *testing.T) {
+	tests := []struct {
+		name       string
+		tags       []string
+		serverTags []string
+		want       bool
+	}{
+		{name: "no_tags", tags: nil, serverTags: []string{"primary"}, want: true},
+		{name: "match", tags: []string{"primary", "cmdb"}, serverTags: []string{"cmdb", "primary"}, want: true},
+		{name: "missing", tags: []string{"primary", "cmdb"}, serverTags: []string{"primary"}, want: false},
+		{name: "negation", tags: []string{"!standby"}, serverTags: []string{"primary"}, want: true},
+		{name: "negation_present", tags: []string{"!standby"}, serverTags: []string{"standby", "postgres"}, want: false},
+		{name: "negation_no_server_tags", tags: []string{"!standby"}, serverTags: nil, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := &Query{Tags: tt.tags}
+			assert.Equal(t, tt.want, q.MatchTags(tt.serverTags))
+		})
+	}
+}
+
+func TestQueryInstance_GetTaggedQuerySQL(t *testing.T) {
+	q := &QueryInstance{
+		Name: "pg_tagged",
+		Queries: []*Query{
+			{SQL: "SELECT primary", Tags: []string{"primary", "!cmdb"}},
+			{SQL: "SELECT other"},
+		},
+		Metrics: []*Column{{Name: "value", Usage: GAUGE}},
+	}
+	assert.NoError(t, q.Check())
+	ver := semver.MustParse("1.0.0")
+	assert.Equal(t, "SELECT primary", q.GetTaggedQuerySQL(ver, true, []string{"primary"}).SQL)
+	assert.Equal(t, "SELECT other", q.GetTaggedQuerySQL(ver, true, []string{"primary", "cmdb"}).SQL)
+	assert.Equal(t, "SELECT primary", q.GetQuerySQL(ver, true).SQL)
+}
+
+func Test_sortQueries(t *testing.T) {
+	queries := []*QueryInstance{
+		{Name: "pg_b"},
+		{Name: "pg_user", Priority: 10},
+		{Name: "pg_conf", Priority: 101},
+		{Name: "pg_a"},
+	}
+	sortQueries(queries)
+	var names []string
+	for _, q := range queries {
+		names = append(names, q.Name)
+	}
+	assert.Equal(t, []string{"pg_user", "pg_a", "pg_b", "pg_conf"}, names)
+	assert.Equal(t, defaultPriority, queries[1].GetPriority())
+}
+
+func TestQueryInstance_Check_maxRows(t *testing.T) {
+	q := &QueryInstance{
+		Name:      "pg_stat_activity",
+		MaxRows:   100,
+		MaxSeries: -1,
+		Queries: []*Query{
+			{SQL: "SELECT 1", Version: ">=2.0.0"},
+			{SQL: "SELECT 2", Version: "<2.0.0", MaxRows: 10, MaxSeries: 50},
+		},
+		Metrics: []*Column{{Name: "value", Usage: GAUGE}},
+	}
+	assert.NoError(t, q.Check())
+	assert.Equal(t, 0, q.MaxSeries)
+	assert.Equal(t, 100, q.Queries[0].MaxRows)
+	assert.Equal(t, 0, q.Queries[0].MaxSeries)
+	assert.Equal(t, 10, q.Queries[1].MaxRows)
+	assert.Equal(t, 50, q.Queries[1].MaxSeries)
+}
@@ -2,24 +2,174 @@
 
 package exporter
 
-type rateLimit struct {
-	token chan struct{}
+import (
+	"container/list"
+	"context"
+	"github.com/prometheus/common/log"
+	"sync"
+)
+
+// queryLimit context-aware weighted semaphore limiting queries running on databases.
+// one limit is shared by all servers of an exporter, so --parallel guards the total database load
+type queryLimit struct {
+	mu       sync.Mutex
+	size     int64
+	cur      int64
+	waiters  list.List // *limitWaiter, first come first served
+	inFlight int64     // number of queries holding weight
 }
 
-func newRateLimit(n int) *rateLimit {
-	return &rateLimit{
-		token: make(chan struct{}, n),
-	}
+type limitWaiter struct {
+	n     int64
+	ready chan struct{} // closed when weight is acquired
 }
 
-func (r *rateLimit) getToken() {
-	r.token <- struct{}{}
+func newQueryLimit(n int) *queryLimit {
+	if n <= 0 {
+		n = 1
+	}
+	return &queryLimit{size: int64(n)}
 }
 
-func (r *rateLimit) putToken() {
+// Acquire take weight n, blocking until it is available or ctx is done. weight is at most the size of limit
+func (l *queryLimit) Acquire(ctx context.Context, n int) error {
+	weight := l.weight(n)
+	l.mu.Lock()
+	if l.size-l.cur >= weight && l.waiters.Len() == 0 {
+		l.cur += weight
+		l.inFlight++
+		l.mu.Unlock()
+		return nil
+	}
+	w := &limitWaiter{n: weight, ready: make(chan struct{})}
+	elem := l.waiters.PushBack(w)
+	l.mu.Unlock()
+
 	select {
-	case <-r.token:
-	default:
-		panic("put a redundant token")
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		select {
+		case <-w.ready:
+			// acquired while being canceled, give it back
+			l.mu.Unlock()
+			l.Release(n)
+			return ctx.Err()
+		default:
+		}
+		isFront := l.waiters.Front() == elem
+		l.waiters.Remove(elem)
+		// a large waiter at front may block smaller ones behind it
+		if isFront && l.size > l.cur {
+			l.notifyWaiters()
+		}
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// Release give back weight n taken by Acquire
+func (l *queryLimit) Release(n int) {
+	weight := l.weight(n)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.cur < weight || l.inFlight <= 0 {
+		log.Errorf("release weight %d of query limit more than held %d", weight, l.cur)
+		return
+	}
+	l.cur -= weight
+	l.inFlight--
+	l.notifyWaiters()
+}
+
+// notifyWaiters wake waiters in order as long as their weight fit, must be called with mu held
+func (l *queryLimit) notifyWaiters() {
+	for {
+		front := l.waiters.Front()
+		if front == nil {
+			return
+		}
+		w := front.Value.(*limitWaiter)
+		if l.size-l.cur < w.n {
+			return
+		}
+		l.cur += w.n
+		l.inFlight++
+		l.waiters.Remove(front)
+		close(w.ready)
+	}
+}
+
+func (l *queryLimit) weight(n int) int64 {
+	weight := int64(n)
+	if weight <= 0 {
+		weight = 1
+	}
+	if weight > l.size {
+		weight = l.size
+	}
+	return weight
+}
+
+// Stats returns number of queries running and waiting
+func (l *queryLimit) Stats() (inFlight, waiting int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.inFlight), l.waiters.Len()
+}
+
+// classLimit limits concurrent queries of the same concurrency class, classes without limit are not limited.
+// one limit is shared by all servers of an exporter, like queryLimit
+type classLimit struct {
+	mu       sync.Mutex
+	limits   map[string]int
+	running  map[string]int
+	released chan struct{} // closed and renewed when a token of limited class is put back, wakes all waiters
+}
+
+func newClassLimit(limits map[string]int) *classLimit {
+	return &classLimit{
+		limits:   limits,
+		running:  make(map[string]int),
+		released: make(chan struct{}),
+	}
+}
+
+// releasedCh returns channel closed when a token is put back. take it before trying tokens, so no release is missed
+func (c *classLimit) releasedCh() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.released
+}
+
+// tryGetToken take a token of class without blocking, false if class is full
+func (c *classLimit) tryGetToken(class string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	limit, ok := c.limits[class]
+	if !ok {
+		return true
+	}
+	if c.running[class] >= limit {
+		return false
+	}
+	c.running[class]++
+	return true
+}
+
+// putToken give back a token of class taken by tryGetToken
+func (c *classLimit) putToken(class string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.limits[class]; !ok {
+		return
+	}
+	if c.running[class] <= 0 {
+		log.Errorf("put a redundant token of class %s", class)
+		return
 	}
+	c.running[class]--
+	close(c.released)
+	c.released = make(chan struct{})
 }
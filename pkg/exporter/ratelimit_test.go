@@ -3,30 +3,77 @@
 package exporter
 
 import (
+	"context"
+	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 )
 
-func Test_RateLimit(t *testing.T) {
-	type args struct {
-		n int
-	}
-	tests := []struct {
-		name string
-		args args
-		want *rateLimit
-	}{
-		{
-			name: "RateLimit",
-			args: args{n: 30},
-			want: &rateLimit{token: make(chan struct{}, 30)},
-		},
-	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			got := newRateLimit(tt.args.n)
-			got.getToken()
-			got.putToken()
+func Test_queryLimit(t *testing.T) {
+	t.Run("weight", func(t *testing.T) {
+		l := newQueryLimit(3)
+		assert.NoError(t, l.Acquire(context.Background(), 2))
+		assert.NoError(t, l.Acquire(context.Background(), 1))
+		inFlight, waiting := l.Stats()
+		assert.Equal(t, 2, inFlight)
+		assert.Equal(t, 0, waiting)
+		l.Release(2)
+		l.Release(1)
+		// weight larger than limit is clamped
+		assert.NoError(t, l.Acquire(context.Background(), 10))
+		l.Release(10)
+		inFlight, _ = l.Stats()
+		assert.Equal(t, 0, inFlight)
+	})
+	t.Run("redundant_release", func(t *testing.T) {
+		l := newQueryLimit(1)
+		assert.NotPanics(t, func() { l.Release(1) })
+	})
+	t.Run("wait", func(t *testing.T) {
+		l := newQueryLimit(1)
+		assert.NoError(t, l.Acquire(context.Background(), 1))
+		acquired := make(chan error)
+		go func() {
+			acquired <- l.Acquire(context.Background(), 1)
+		}()
+		assert.Eventually(t, func() bool {
+			_, waiting := l.Stats()
+			return waiting == 1
+		}, time.Second, time.Millisecond)
+		l.Release(1)
+		assert.NoError(t, <-acquired)
+		l.Release(1)
+	})
+	t.Run("canceled", func(t *testing.T) {
+		l := newQueryLimit(1)
+		assert.NoError(t, l.Acquire(context.Background(), 1))
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		assert.Equal(t, context.DeadlineExceeded, l.Acquire(ctx, 1))
+		_, waiting := l.Stats()
+		assert.Equal(t, 0, waiting)
+		l.Release(1)
+		assert.NoError(t, l.Acquire(context.Background(), 1))
+	})
+}
 
-		})
+func Test_classLimit(t *testing.T) {
+	c := newClassLimit(map[string]int{"heavy": 1})
+	assert.Equal(t, true, c.tryGetToken("heavy"))
+	assert.Equal(t, false, c.tryGetToken("heavy"))
+	// classes without limit are never full
+	assert.Equal(t, true, c.tryGetToken(""))
+	assert.Equal(t, true, c.tryGetToken(""))
+	released := c.releasedCh()
+	c.putToken("")
+	c.putToken("heavy")
+	select {
+	case <-released:
+	default:
+		t.Error("class token put back without release signal")
 	}
+	// a redundant token is ignored, the class is still limited
+	c.putToken("heavy")
+	assert.Equal(t, true, c.tryGetToken("heavy"))
+	assert.Equal(t, false, c.tryGetToken("heavy"))
 }
@@ -3,24 +3,29 @@
 package exporter
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
-	"gitee.com/opengauss/openGauss-connector-go-pq"
+	_ "gitee.com/opengauss/openGauss-connector-go-pq" // register opengauss driver
 	"github.com/blang/semver"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
 	"github.com/sirupsen/logrus"
 	"math"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var (
-	serverLabelName = "server"
-	staticLabelName = "static"
+	serverLabelName   = "server"
+	databaseLabelName = "database"
+	staticLabelName   = "static"
 )
 
 // ServerOpt configures a server.
@@ -61,13 +66,59 @@ func ServerWithTimeToString(b bool) ServerOpt {
 	}
 }
 
+// ServerWithAsyncCollect will run queries in background scheduler, scrape only serve the latest results
+func ServerWithAsyncCollect(b bool) ServerOpt {
+	return func(s *Server) {
+		s.asyncCollect = b
+	}
+}
+
 func ServerWithParallel(i int) ServerOpt {
 	return func(s *Server) {
 		s.parallel = i
 	}
 }
 
+// ServerWithTags will register given tags to server, queries run only when tags of server satisfy theirs
+func ServerWithTags(tags []string) ServerOpt {
+	return func(s *Server) {
+		s.tags = tags
+	}
+}
+
+// ServerWithQueryLimit will share the limit of concurrent queries with other servers
+func ServerWithQueryLimit(limit *queryLimit) ServerOpt {
+	return func(s *Server) {
+		s.queryLimit = limit
+	}
+}
+
+// ServerWithClassLimit will share the limit of concurrent queries of each concurrency class with other servers
+func ServerWithClassLimit(limit *classLimit) ServerOpt {
+	return func(s *Server) {
+		s.classLimit = limit
+	}
+}
+
+// ServerWithScrapeBudget will limit the duration of a scrape, queries could not fit the time left are skipped
+func ServerWithScrapeBudget(d time.Duration) ServerOpt {
+	return func(s *Server) {
+		s.scrapeBudget = d
+	}
+}
+
+// ServerWithQueryInstanceMap will specify queries of server, used when server do not share queries with other dsn
+func ServerWithQueryInstanceMap(queries map[string]*QueryInstance) ServerOpt {
+	return func(s *Server) {
+		s.queryInstanceMap = queries
+	}
+}
+
 type Server struct {
+	// accessed atomically by concurrent queries, keep first for 64-bit alignment
+	ScrapeTotalCount int64 // 采集指标个数
+	ScrapeErrorCount int64 // 采集失败个数
+
 	fingerprint            string
 	dsn                    string
 	db                     *sql.DB
@@ -78,22 +129,30 @@ type Server struct {
 	notCollInternalMetrics bool // 不采集部分指标
 	disableCache           bool
 	timeToString           bool
-
-	parallel int
+	asyncCollect           bool     // run queries in background scheduler
+	tags                   []string // static tags from --tags
+	database               string   // database name of dsn, used as dynamic tag
+
+	parallel   int
+	classLimit *classLimit // limit of concurrent queries of each class shared by servers, nil classes are not limited
+	queryLimit *queryLimit // limit of concurrent queries shared by servers, nil use own limit of parallel
+	// max duration of a scrape, 0 only the deadline of scrape context is used
+	scrapeBudget time.Duration
 	// Last version used to calculate metric map. If mismatch on scrape,
 	// then maps are recalculated.
 	lastMapVersion semver.Version
 	// Currently active metric map
 	queryInstanceMap map[string]*QueryInstance
-	lock             sync.RWMutex
+	lock             sync.RWMutex // protect queries, version and role, held only to read or replace them
+	scrapeMtx        sync.Mutex   // internal metrics of concurrent scrapes are updated one at a time
+	flight           flightGroup  // concurrent executions of the same query are coalesced
+	scheduler        scheduler    // background scheduler of async collect
 	// Currently cached metrics
-	cacheMtx         sync.Mutex
-	metricCache      map[string]*cachedMetrics
-	UP               bool
-	ScrapeTotalCount int64     // 采集指标个数
-	ScrapeErrorCount int64     // 采集失败个数
-	scrapeBegin      time.Time // server level scrape begin
-	scrapeDone       time.Time // server last scrape done
+	cacheMtx    sync.Mutex
+	metricCache map[string]*cachedMetrics
+	UP          bool
+	scrapeBegin time.Time // server level scrape begin
+	scrapeDone  time.Time // server last scrape done
 
 	up               prometheus.Gauge
 	recovery         prometheus.Gauge   // postgres is in recovery ?
@@ -102,12 +161,8 @@ type Server struct {
 	scrapeTotalCount prometheus.Counter // exporter level: total scrape count of this server
 	scrapeErrorCount prometheus.Counter // exporter level: error scrape count
 
-	queryCacheTTL          map[string]float64 // internal query metrics: cache time to live
-	queryScrapeTotalCount  map[string]float64 // internal query metrics: total executed
-	queryScrapeHitCount    map[string]float64 // internal query metrics: times serving from hit cache
-	queryScrapeErrorCount  map[string]float64 // internal query metrics: times failed
-	queryScrapeMetricCount map[string]float64 // internal query metrics: number of metrics scrapped
-	queryScrapeDuration    map[string]float64 // internal query metrics: time spend on executing
+	queryStats queryStats // internal query metrics: cache ttl, executions, cache hits, metrics, duration, errors of each query
+	breakers   breakers   // circuit breakers of queries failed repeatedly
 }
 
 // Close disconnects from OpenGauss.
@@ -122,7 +177,12 @@ func (s *Server) Close() error {
 
 // Ping checks connection availability and possibly invalidates the connection if it fails.
 func (s *Server) Ping() error {
-	if err := s.db.Ping(); err != nil {
+	return s.PingContext(context.Background())
+}
+
+// PingContext same as Ping, ctx cancel the ping
+func (s *Server) PingContext(ctx context.Context) error {
+	if err := s.db.PingContext(ctx); err != nil {
 		if closeErr := s.Close(); closeErr != nil {
 			log.Errorf("Error while closing non-pinging DB connection to %q: %v", s, closeErr)
 		}
@@ -137,31 +197,43 @@ func (s *Server) String() string {
 }
 
 // Scrape loads metrics.
-func (s *Server) Scrape(ch chan<- prometheus.Metric) error {
+func (s *Server) Scrape(ctx context.Context, ch chan<- prometheus.Metric) error {
 	if err := s.CheckConn(); err != nil {
 		return err
 	}
 
-	s.lock.RLock()
-	defer s.lock.RUnlock()
-	if !s.notCollInternalMetrics {
-		_ = s.setupServerInternalMetrics()
+	// concurrent scrapes of same server run together, the same query is executed once
+	queryInstanceMap, notCollInternalMetrics := s.queries()
+	scrapeBegin := time.Now()
+	if s.scrapeBudget > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.scrapeBudget)
+		defer cancel()
 	}
-	s.scrapeBegin = time.Now()
 
 	var err error
 
-	if !s.disableSettingsMetrics && !s.notCollInternalMetrics {
-		if err = s.querySettings(ch); err != nil {
-			err = fmt.Errorf("error retrieving settings: %s", err)
+	if s.asyncCollect {
+		// queries run in background scheduler, only serve the latest snapshot
+		err = s.scrapeSnapshot(ctx, ch)
+	} else {
+		if !s.disableSettingsMetrics && !notCollInternalMetrics {
+			if err = s.querySettings(ctx, ch); err != nil {
+				err = fmt.Errorf("error retrieving settings: %s", err)
+			}
 		}
-	}
 
-	errMap := s.queryMetrics(ch)
-	if len(errMap) > 0 {
-		err = fmt.Errorf("queryMetrics returned %d errors", len(errMap))
+		errMap := s.queryMetrics(ctx, ch)
+		if len(errMap) > 0 {
+			err = fmt.Errorf("queryMetrics returned %d errors", len(errMap))
+		}
 	}
-	if !s.notCollInternalMetrics {
+	if !notCollInternalMetrics {
+		// internal metrics are shared, update them one scrape at a time
+		s.scrapeMtx.Lock()
+		defer s.scrapeMtx.Unlock()
+		_ = s.setupServerInternalMetrics()
+		s.scrapeBegin = scrapeBegin
 		s.scrapeDone = time.Now()
 		// 最后采集时间
 		s.lastScrapeTime.Set(float64(s.scrapeDone.Unix()))
@@ -170,10 +242,70 @@ func (s *Server) Scrape(ch chan<- prometheus.Metric) error {
 
 		s.collectorServerInternalMetrics(ch)
 	}
+	// queries of discovered databases have their own statistics and circuit breakers
+	statsLabels := s.statsLabels()
+	s.queryStats.collect(ch, s.namespace, statsLabels)
+	queries := make([]string, 0, len(queryInstanceMap))
+	for name := range queryInstanceMap {
+		queries = append(queries, name)
+	}
+	s.breakers.collect(ch, s.namespace, statsLabels, queries)
 
 	return err
 }
 
+// statsLabels labels of query statistics, databases discovered on the same server are told apart by database
+func (s *Server) statsLabels() prometheus.Labels {
+	labels := make(prometheus.Labels, len(s.labels)+1)
+	for k, v := range s.labels {
+		labels[k] = v
+	}
+	labels[databaseLabelName] = s.database
+	return labels
+}
+
+// queries returns current queries and whether internal metrics are skipped. the map is replaced, never modified,
+// so a scrape or a scheduler round works on it without holding lock, and a reload is not blocked by slow queries
+func (s *Server) queries() (map[string]*QueryInstance, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.queryInstanceMap, s.notCollInternalMetrics
+}
+
+// versionRole returns version and role of server, updated by GetServer
+func (s *Server) versionRole() (semver.Version, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.lastMapVersion, s.primary
+}
+
+// setQueryInstanceMap set queries of next scrape, running scrape and background queries keep the ones they started with.
+// only the scraping goroutine writes them, so unchanged queries are checked without lock
+func (s *Server) setQueryInstanceMap(queries map[string]*QueryInstance, notCollInternalMetrics bool) {
+	s.lock.RLock()
+	unchanged := s.notCollInternalMetrics == notCollInternalMetrics && sameQueries(s.queryInstanceMap, queries)
+	s.lock.RUnlock()
+	if unchanged {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.queryInstanceMap = queries
+	s.notCollInternalMetrics = notCollInternalMetrics
+}
+
+func sameQueries(a, b map[string]*QueryInstance) bool {
+	if len(a) != len(b) || (a == nil) != (b == nil) {
+		return false
+	}
+	for name, q := range a {
+		if b[name] != q {
+			return false
+		}
+	}
+	return true
+}
+
 func (s *Server) setupServerInternalMetrics() error {
 
 	s.scrapeTotalCount = prometheus.NewCounter(prometheus.CounterOpts{
@@ -204,12 +336,13 @@ func (s *Server) setupServerInternalMetrics() error {
 }
 
 func (s *Server) collectorServerInternalMetrics(ch chan<- prometheus.Metric) {
-	if s.notCollInternalMetrics {
+	if _, notCollInternalMetrics := s.queries(); notCollInternalMetrics {
 		return
 	}
+	lastMapVersion, primary := s.versionRole()
 	if s.UP {
 		s.up.Set(1)
-		if s.primary {
+		if primary {
 			s.recovery.Set(0)
 		} else {
 			s.recovery.Set(1)
@@ -222,9 +355,9 @@ func (s *Server) collectorServerInternalMetrics(ch chan<- prometheus.Metric) {
 	versionDesc := prometheus.NewDesc(fmt.Sprintf("%s_%s", s.namespace, "version"),
 		"Version string as reported by OpenGauss", []string{"version", "short_version"}, s.labels)
 	version := prometheus.MustNewConstMetric(versionDesc,
-		prometheus.UntypedValue, 1, s.lastMapVersion.String(), s.lastMapVersion.String())
-	s.scrapeTotalCount.Add(float64(s.ScrapeTotalCount))
-	s.scrapeErrorCount.Add(float64(s.ScrapeErrorCount))
+		prometheus.UntypedValue, 1, lastMapVersion.String(), lastMapVersion.String())
+	s.scrapeTotalCount.Add(float64(atomic.LoadInt64(&s.ScrapeTotalCount)))
+	s.scrapeErrorCount.Add(float64(atomic.LoadInt64(&s.ScrapeErrorCount)))
 
 	ch <- s.up
 	ch <- s.recovery
@@ -233,8 +366,67 @@ func (s *Server) collectorServerInternalMetrics(ch chan<- prometheus.Metric) {
 	ch <- s.scrapeDuration
 	ch <- s.lastScrapeTime
 	ch <- version
+	s.collectTLS(ch)
+}
+
+// ServerStatus state of a server reported by admin API
+type ServerStatus struct {
+	Server     string    `json:"server"`   // fingerprint, host:port
+	DSN        string    `json:"dsn"`      // dsn with password shadowed
+	Database   string    `json:"database"` // database name of dsn
+	Up         bool      `json:"up"`
+	Primary    bool      `json:"primary"`
+	LastScrape time.Time `json:"last_scrape"` // zero if never scraped
+}
+
+// Status returns state of server, password in dsn is shadowed
+func (s *Server) Status() ServerStatus {
+	_, primary := s.versionRole()
+	s.scrapeMtx.Lock()
+	lastScrape := s.scrapeDone
+	s.scrapeMtx.Unlock()
+	return ServerStatus{
+		Server:     s.String(),
+		DSN:        ShadowDSN(s.dsn),
+		Database:   s.database,
+		Up:         s.UP,
+		Primary:    primary,
+		LastScrape: lastScrape,
+	}
+}
+
+// ResetBreaker close circuit breaker of query, all queries if query is empty. returns number of breakers reset
+func (s *Server) ResetBreaker(query string) int {
+	return s.breakers.reset(query)
+}
 
+// Tags returns static tags and dynamic tags of server: primary or standby, and the database name
+func (s *Server) Tags() []string {
+	_, primary := s.versionRole()
+	return s.roleTags(primary)
 }
+
+// roleTags returns tags of server in role primary or standby
+func (s *Server) roleTags(primary bool) []string {
+	tags := make([]string, 0, len(s.tags)+2)
+	tags = append(tags, s.tags...)
+	if primary {
+		tags = append(tags, "primary")
+	} else {
+		tags = append(tags, "standby")
+	}
+	if s.database != "" {
+		tags = append(tags, s.database)
+	}
+	return tags
+}
+
+// querySQL returns query sql fit the version, role and tags of server
+func (s *Server) querySQL(queryInstance *QueryInstance) *Query {
+	version, primary := s.versionRole()
+	return queryInstance.GetTaggedQuerySQL(version, primary, s.roleTags(primary))
+}
+
 func (s *Server) CheckConn() error {
 	if s.db == nil || !s.UP {
 		return fmt.Errorf("not connect database")
@@ -243,7 +435,7 @@ func (s *Server) CheckConn() error {
 }
 
 // IsPrimary return true is primary database. false is standby database
-func (s *Server) IsPrimary() (bool, error) {
+func (s *Server) IsPrimary(ctx context.Context) (bool, error) {
 
 	if err := s.CheckConn(); err != nil {
 		return false, err
@@ -252,14 +444,14 @@ func (s *Server) IsPrimary() (bool, error) {
 	var b bool
 	sqlText := "SELECT pg_is_in_recovery()"
 	logrus.Debugf(sqlText)
-	if err := s.db.QueryRow(sqlText).Scan(&b); err != nil {
+	if err := s.db.QueryRowContext(ctx, sqlText).Scan(&b); err != nil {
 		return false, err
 	}
 	return !b, nil
 }
 
 func (s *Server) DBRole() string {
-	if s.primary {
+	if _, primary := s.versionRole(); primary {
 		return "primary"
 	}
 	return "standby"
@@ -267,8 +459,8 @@ func (s *Server) DBRole() string {
 
 // 连接数据查询监控指标
 
-func (s *Server) QueryDatabases() ([]string, error) {
-	rows, err := s.db.Query(`SELECT datname FROM pg_database
+func (s *Server) QueryDatabases(ctx context.Context) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT datname FROM pg_database
 	WHERE datallowconn = true
 	AND datistemplate = false
 	AND datname != current_database()`) // nolint: safesql
@@ -291,13 +483,13 @@ func (s *Server) QueryDatabases() ([]string, error) {
 	}
 	return result, nil
 }
-func (s *Server) getVersion() error {
+func (s *Server) getVersion(ctx context.Context) error {
 
 	if err := s.CheckConn(); err != nil {
 		return err
 	}
 	var versionString string
-	err := s.db.QueryRow("SELECT version();").Scan(&versionString)
+	err := s.db.QueryRowContext(ctx, "SELECT version();").Scan(&versionString)
 	if err != nil {
 		return err
 	}
@@ -305,10 +497,14 @@ func (s *Server) getVersion() error {
 	if err != nil {
 		return fmt.Errorf("Error parsing version string err %s ", err)
 	}
-	s.lastMapVersion = semanticVersion
+	if !s.lastMapVersion.Equals(semanticVersion) {
+		s.lock.Lock()
+		s.lastMapVersion = semanticVersion
+		s.lock.Unlock()
+	}
 	return nil
 }
-func (s *Server) ConnectDatabase() error {
+func (s *Server) ConnectDatabase(ctx context.Context) error {
 	db, err := sql.Open("opengauss", s.dsn)
 	s.db = db
 	if err != nil {
@@ -316,7 +512,7 @@ func (s *Server) ConnectDatabase() error {
 		return err
 	}
 
-	if err = s.Ping(); err != nil {
+	if err = s.PingContext(ctx); err != nil {
 		return err
 	}
 	s.db.SetConnMaxIdleTime(120 * time.Second)
@@ -326,7 +522,12 @@ func (s *Server) ConnectDatabase() error {
 	return nil
 }
 
-func NewServer(dsn string, opts ...ServerOpt) (*Server, error) {
+func NewServer(ctx context.Context, dsn string, opts ...ServerOpt) (*Server, error) {
+	// driver errors of malformed dsn may quote the password
+	settings, err := parseDsn(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("malformed dsn %q: %s", ShadowDSN(dsn), err)
+	}
 	// 获取server名称 ip:port
 	fingerprint, err := parseFingerprint(dsn)
 	if err != nil {
@@ -345,11 +546,13 @@ func NewServer(dsn string, opts ...ServerOpt) (*Server, error) {
 		metricCache: make(map[string]*cachedMetrics),
 	}
 
+	s.database = settings["database"]
+
 	for _, opt := range opts {
 		opt(s)
 	}
 
-	if err = s.ConnectDatabase(); err != nil {
+	if err = s.ConnectDatabase(ctx); err != nil {
 		return s, err
 	}
 	return s, nil
@@ -359,21 +562,56 @@ func NewServer(dsn string, opts ...ServerOpt) (*Server, error) {
 type Servers struct {
 	m       sync.Mutex
 	servers map[string]*Server
+	locks   map[string]*sync.Mutex // per dsn lock, connecting to one server do not block others
 	opts    []ServerOpt
+
+	// eviction of servers not used recently, for targets coming from requests like /probe. 0 never evict
+	idleTimeout time.Duration
+	maxServers  int
+	lastUsed    map[string]time.Time
+	inUse       map[string]int // servers being used are never evicted
 }
 
 // NewServers creates a collection of servers to OpenGauss.
 func NewServers(opts ...ServerOpt) *Servers {
 	return &Servers{
-		servers: make(map[string]*Server),
-		opts:    opts,
+		servers:  make(map[string]*Server),
+		locks:    make(map[string]*sync.Mutex),
+		opts:     opts,
+		lastUsed: make(map[string]time.Time),
+		inUse:    make(map[string]int),
+	}
+}
+
+func (s *Servers) dsnLock(dsn string) *sync.Mutex {
+	s.m.Lock()
+	defer s.m.Unlock()
+	l, ok := s.locks[dsn]
+	if !ok {
+		l = &sync.Mutex{}
+		s.locks[dsn] = l
 	}
+	return l
+}
+
+func (s *Servers) get(dsn string) (*Server, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	server, ok := s.servers[dsn]
+	return server, ok
 }
 
-// GetServer returns established connection from a collection.
-func (s *Servers) GetServer(dsn string) (*Server, error) {
+func (s *Servers) put(dsn string, server *Server) {
 	s.m.Lock()
 	defer s.m.Unlock()
+	s.servers[dsn] = server
+}
+
+// GetServer returns established connection from a collection. retries stop when ctx is done
+func (s *Servers) GetServer(ctx context.Context, dsn string) (*Server, error) {
+	l := s.dsnLock(dsn)
+	l.Lock()
+	defer l.Unlock()
 	var err error
 	var ok bool
 	errCount := 0 // start at zero because we increment before doing work
@@ -383,52 +621,198 @@ func (s *Servers) GetServer(dsn string) (*Server, error) {
 		if errCount++; errCount > retries {
 			return nil, err
 		}
-		server, ok = s.servers[dsn]
+		server, ok = s.get(dsn)
 		if !ok {
-			server, err = NewServer(dsn, s.opts...)
+			server, err = NewServer(ctx, dsn, s.opts...)
+			if server == nil {
+				// malformed dsn, retry would not help
+				log.Errorf("new server %s err %s", ShadowDSN(dsn), err)
+				return nil, err
+			}
 			if err != nil {
 				log.Errorf("new server %s err %s", server.fingerprint, err)
-				time.Sleep(time.Duration(errCount) * time.Second)
+				if sleepErr := sleepContext(ctx, time.Duration(errCount)*time.Second); sleepErr != nil {
+					return nil, err
+				}
 				continue
 			}
-			s.servers[dsn] = server
+			s.put(dsn, server)
 		}
 		if !server.UP {
-			if err = server.ConnectDatabase(); err != nil {
+			if err = server.ConnectDatabase(ctx); err != nil {
 				log.Errorf("new server %s err %s", server.fingerprint, err)
-				time.Sleep(time.Duration(errCount) * time.Second)
+				if sleepErr := sleepContext(ctx, time.Duration(errCount)*time.Second); sleepErr != nil {
+					return nil, err
+				}
 				continue
 			}
 		}
-		if err = server.Ping(); err != nil {
+		if err = server.PingContext(ctx); err != nil {
 			// delete(s.servers, dsn)
 			log.Errorf("ping %s err %s", server.fingerprint, err)
-			time.Sleep(time.Duration(errCount) * time.Second)
+			if sleepErr := sleepContext(ctx, time.Duration(errCount)*time.Second); sleepErr != nil {
+				return nil, err
+			}
 			continue
 		}
 		break
 	}
-	isPrimary, err := server.IsPrimary()
+	isPrimary, err := server.IsPrimary(ctx)
 	if err != nil {
 		// log.Errorf("Error querying IsPrimary (%s): %v", ShadowDSN(dsn), err)
 		return nil, err
 	}
 	// If autoDiscoverDatabases is true, set first dsn as primary database (Default: false)
-	server.primary = isPrimary
+	if server.primary != isPrimary {
+		server.lock.Lock()
+		server.primary = isPrimary
+		server.lock.Unlock()
+	}
 	// server.primary = false
 
-	if err = server.getVersion(); err != nil {
+	if err = server.getVersion(ctx); err != nil {
 		return nil, err
 	}
 
 	return server, nil
 }
 
+// sleepContext sleep d, return ctx error if ctx is done before
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// list returns known servers
+func (s *Servers) list() []*Server {
+	s.m.Lock()
+	defer s.m.Unlock()
+	servers := make([]*Server, 0, len(s.servers))
+	for _, server := range s.servers {
+		servers = append(servers, server)
+	}
+	return servers
+}
+
+// prune close servers whose dsn is not in targets anymore, like a target removed or its credentials rotated.
+// servers of databases discovered on a target are kept along with the target
+func (s *Servers) prune(targets []string) {
+	keep := make(map[string]bool, len(targets))
+	var keepSettings []map[string]string
+	for _, target := range targets {
+		keep[target] = true
+		if settings, err := parseDsn(target); err == nil {
+			delete(settings, "database")
+			keepSettings = append(keepSettings, settings)
+		}
+	}
+	var stale []*Server
+	s.m.Lock()
+	for dsn, server := range s.servers {
+		if keep[dsn] {
+			continue
+		}
+		settings, err := parseDsn(dsn)
+		if err != nil {
+			continue
+		}
+		delete(settings, "database")
+		if containsSettings(keepSettings, settings) {
+			continue
+		}
+		delete(s.servers, dsn)
+		stale = append(stale, server)
+	}
+	s.m.Unlock()
+	for _, server := range stale {
+		log.Infof("target %s removed or its credentials changed, close connection", ShadowDSN(server.dsn))
+		server.stopScheduler()
+		if err := server.Close(); err != nil {
+			log.Errorf("failed to close connection to %q: %v", server, err)
+		}
+	}
+}
+
+// acquire get server of dsn and mark it in use until release
+func (s *Servers) acquire(ctx context.Context, dsn string) (*Server, error) {
+	s.m.Lock()
+	s.inUse[dsn]++
+	s.m.Unlock()
+	return s.GetServer(ctx, dsn)
+}
+
+// release mark server of dsn not in use, then evict servers idle too long or over the max number
+func (s *Servers) release(dsn string) {
+	s.m.Lock()
+	if s.inUse[dsn]--; s.inUse[dsn] <= 0 {
+		delete(s.inUse, dsn)
+	}
+	s.lastUsed[dsn] = time.Now()
+	s.m.Unlock()
+	s.evict()
+}
+
+// evict close servers not used for idleTimeout, and the least recently used ones over maxServers
+func (s *Servers) evict() {
+	if s.idleTimeout <= 0 && s.maxServers <= 0 {
+		return
+	}
+	now := time.Now()
+	var evicted []*Server
+	s.m.Lock()
+	var idle []string // not in use, the least recently used first
+	for dsn := range s.lastUsed {
+		if s.inUse[dsn] == 0 {
+			idle = append(idle, dsn)
+		}
+	}
+	sort.Slice(idle, func(i, j int) bool {
+		return s.lastUsed[idle[i]].Before(s.lastUsed[idle[j]])
+	})
+	over := len(s.servers) - s.maxServers
+	for _, dsn := range idle {
+		if !(s.idleTimeout > 0 && now.Sub(s.lastUsed[dsn]) >= s.idleTimeout) && !(s.maxServers > 0 && over > 0) {
+			continue
+		}
+		if server, ok := s.servers[dsn]; ok {
+			evicted = append(evicted, server)
+			delete(s.servers, dsn)
+			over--
+		}
+		delete(s.lastUsed, dsn)
+		delete(s.locks, dsn)
+	}
+	s.m.Unlock()
+	for _, server := range evicted {
+		log.Infof("close idle connection to %s", ShadowDSN(server.dsn))
+		server.stopScheduler()
+		if err := server.Close(); err != nil {
+			log.Errorf("failed to close connection to %q: %v", server, err)
+		}
+	}
+}
+
+func containsSettings(list []map[string]string, settings map[string]string) bool {
+	for _, s := range list {
+		if reflect.DeepEqual(s, settings) {
+			return true
+		}
+	}
+	return false
+}
+
 // Close disconnects from all known servers.
 func (s *Servers) Close() {
 	s.m.Lock()
 	defer s.m.Unlock()
 	for _, server := range s.servers {
+		server.stopScheduler()
 		if err := server.Close(); err != nil {
 			log.Errorf("failed to close connection to %q: %v", server, err)
 		}
@@ -473,6 +857,55 @@ func dbToFloat64(t interface{}) (float64, bool) {
 	}
 }
 
+// Convert database.sql types to uint64 for Prometheus histogram counts. Null, negative and unparseable values are !ok
+func dbToUint64(t interface{}) (uint64, bool) {
+	v, ok := dbToFloat64(t)
+	if !ok || math.IsNaN(v) || v < 0 {
+		return 0, false
+	}
+	return uint64(v), true
+}
+
+// Convert database.sql array types to []float64 for Prometheus histogram buckets.
+// Arrays arrive from the driver in text form such as {1,2,4,8}
+func dbToFloat64Array(t interface{}) ([]float64, bool) {
+	var text string
+	switch v := t.(type) {
+	case []float64:
+		return v, true
+	case []int64:
+		result := make([]float64, len(v))
+		for i := range v {
+			result[i] = float64(v[i])
+		}
+		return result, true
+	case []byte:
+		text = string(v)
+	case string:
+		text = v
+	default:
+		return nil, false
+	}
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, "{") || !strings.HasSuffix(text, "}") {
+		return nil, false
+	}
+	text = strings.TrimSpace(text[1 : len(text)-1])
+	if text == "" {
+		return []float64{}, true
+	}
+	elems := strings.Split(text, ",")
+	result := make([]float64, len(elems))
+	for i, elem := range elems {
+		f, err := strconv.ParseFloat(strings.Trim(strings.TrimSpace(elem), `"`), 64)
+		if err != nil {
+			return nil, false
+		}
+		result[i] = f
+	}
+	return result, true
+}
+
 // Convert database.sql to string for Prometheus labels. Null types are mapped to empty strings.
 func dbToString(t interface{}, time2string bool) (string, bool) {
 	switch v := t.(type) {
@@ -502,35 +935,18 @@ func dbToString(t interface{}, time2string bool) (string, bool) {
 	}
 }
 
+// parseFingerprint returns host:port of dsn, values may be quoted like paths of certificates
 func parseFingerprint(url string) (string, error) {
-	dsn, err := pq.ParseURL(url)
+	settings, err := parseDsn(url)
 	if err != nil {
-		dsn = url
+		return "", fmt.Errorf("malformed dsn %q: %s", ShadowDSN(url), err)
 	}
-
-	pairs := strings.Split(dsn, " ")
-	kv := make(map[string]string, len(pairs))
-	for _, pair := range pairs {
-		split := strings.SplitN(pair, "=", 2)
-		if len(split) != 2 {
-			return "", fmt.Errorf("malformed dsn %q", dsn)
-		}
-		kv[split[0]] = split[1]
-	}
-
-	var fingerprint string
-
-	if host, ok := kv["host"]; ok {
-		fingerprint += host
-	} else {
-		fingerprint += "localhost"
+	host, port := settings["host"], settings["port"]
+	if host == "" {
+		host = "localhost"
 	}
-
-	if port, ok := kv["port"]; ok {
-		fingerprint += ":" + port
-	} else {
-		fingerprint += ":5432"
+	if port == "" {
+		port = "5432"
 	}
-
-	return fingerprint, nil
+	return host + ":" + port, nil
 }
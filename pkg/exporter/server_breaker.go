@@ -0,0 +1,138 @@
+// Copyright © 2021 Bin Liu <bin.liu@enmotech.com>
+
+package exporter
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// value of exporter_query_breaker_state
+const (
+	breakerClosed   = 0 // query runs normally
+	breakerOpen     = 1 // query failed repeatedly, skipped until backoff expired
+	breakerHalfOpen = 2 // backoff expired, next execution decides whether to close or open again
+)
+
+const (
+	breakerThreshold  = 3                // consecutive failures before the breaker opens
+	breakerMinBackoff = 30 * time.Second // first backoff after the breaker opens
+	breakerMaxBackoff = 30 * time.Minute // backoff doubles on each failed trial, up to this
+)
+
+// breaker circuit breaker of one query
+type breaker struct {
+	failures  int           // consecutive failures
+	backoff   time.Duration // current backoff, 0 if never opened
+	openUntil time.Time     // skip query before this time
+}
+
+func (b *breaker) state(now time.Time) int {
+	switch {
+	case b.failures < breakerThreshold:
+		return breakerClosed
+	case now.Before(b.openUntil):
+		return breakerOpen
+	default:
+		return breakerHalfOpen
+	}
+}
+
+// updateBreaker record result of query execution on its breaker.
+// only sql errors count as failures, timeouts depend on load and are ignored
+func (s *Server) updateBreaker(metricName, reason string) {
+	switch reason {
+	case queryErrorSQL:
+		if backoff, opened := s.breakers.failure(metricName); opened {
+			log.Warnf("Collect Metric [%s] on %s failed repeatedly, skip for %s", metricName, s, backoff)
+		}
+	case queryErrorTimeout:
+	default:
+		s.breakers.success(metricName)
+	}
+}
+
+// breakers circuit breakers of each query of a server, queries failed repeatedly are skipped with exponential backoff
+type breakers struct {
+	mu       sync.Mutex
+	breakers map[string]*breaker
+}
+
+// allow false if breaker of query is open
+func (b *breakers) allow(query string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	br, ok := b.breakers[query]
+	return !ok || br.state(time.Now()) != breakerOpen
+}
+
+// success close breaker of query
+func (b *breakers) success(query string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.breakers, query)
+}
+
+// failure record a failure of query, returns backoff if the breaker opened
+func (b *breakers) failure(query string) (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.breakers == nil {
+		b.breakers = make(map[string]*breaker)
+	}
+	br, ok := b.breakers[query]
+	if !ok {
+		br = &breaker{}
+		b.breakers[query] = br
+	}
+	br.failures++
+	if br.failures < breakerThreshold {
+		return 0, false
+	}
+	// opened, or trial of half-open failed
+	br.backoff *= 2
+	if br.backoff == 0 {
+		br.backoff = breakerMinBackoff
+	}
+	if br.backoff > breakerMaxBackoff {
+		br.backoff = breakerMaxBackoff
+	}
+	br.openUntil = time.Now().Add(br.backoff)
+	return br.backoff, true
+}
+
+// reset close breaker of query, all breakers if query is empty. returns number of breakers reset
+func (b *breakers) reset(query string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if query == "" {
+		n := len(b.breakers)
+		b.breakers = nil
+		return n
+	}
+	if _, ok := b.breakers[query]; !ok {
+		return 0
+	}
+	delete(b.breakers, query)
+	return 1
+}
+
+// collect breaker state of queries
+func (b *breakers) collect(ch chan<- prometheus.Metric, namespace string, labels prometheus.Labels, queries []string) {
+	desc := prometheus.NewDesc(prometheus.BuildFQName(namespace, "exporter_query", "breaker_state"),
+		"circuit breaker state of query, 0 closed 1 open 2 half-open", []string{"query"}, labels)
+	sort.Strings(queries)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	for _, query := range queries {
+		state := breakerClosed
+		if br, ok := b.breakers[query]; ok {
+			state = br.state(now)
+		}
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(state), query)
+	}
+}
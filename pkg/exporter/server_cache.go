@@ -3,7 +3,10 @@
 package exporter
 
 import (
+	"context"
 	"github.com/prometheus/client_golang/prometheus"
+	"math"
+	"sync"
 	"time"
 )
 
@@ -16,14 +19,116 @@ type cachedMetrics struct {
 	collect        bool
 }
 
-// IsValid true is cache valid
+// IsValid true is cache valid. ttl <= 0 never valid, +Inf valid forever
 func (c *cachedMetrics) IsValid(ttl float64) bool {
-	if ttl == 0 {
+	if ttl <= 0 {
 		return false
 	}
+	if math.IsInf(ttl, 1) {
+		return true
+	}
 	return !(time.Now().Sub(c.lastScrape).Seconds() >= ttl)
 }
 
+// IsGood true is cache hold the result of a succeed query. truncated results are good
+func (c *cachedMetrics) IsGood() bool {
+	if c.err != nil {
+		return false
+	}
+	for _, err := range c.nonFatalErrors {
+		if !isTruncated(err) {
+			return false
+		}
+	}
+	return true
+}
+
 func (c *cachedMetrics) IsCollect() bool {
 	return c.collect
 }
+
+// flightCall is an in-flight or completed query execution
+type flightCall struct {
+	done    chan struct{} // closed when execution completed
+	result  *cachedMetrics
+	waiters int                // callers waiting for result, guarded by mu of group
+	cancel  context.CancelFunc // cancel execution, called when the last waiter gives up
+}
+
+// flightGroup coalesces concurrent executions of the same query onto one call
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+// Do executes fn once for concurrent callers of the same key and share its result.
+// fn runs in its own goroutine with its own context: a caller giving up when its ctx is done does not fail
+// the other callers, the context of fn is canceled only when the last caller gives up.
+// shared is true when the result comes from another caller's execution
+func (g *flightGroup) Do(ctx context.Context, key string, fn func(ctx context.Context) *cachedMetrics) (result *cachedMetrics, shared bool, err error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	c, shared := g.calls[key]
+	if !shared {
+		callCtx, cancel := context.WithCancel(context.Background())
+		c = &flightCall{done: make(chan struct{}), cancel: cancel}
+		g.calls[key] = c
+		go func() {
+			defer func() {
+				g.forget(key, c)
+				cancel()
+				close(c.done)
+			}()
+			c.result = fn(callCtx)
+		}()
+	}
+	c.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.result, shared, nil
+	case <-ctx.Done():
+		g.mu.Lock()
+		c.waiters--
+		if c.waiters == 0 {
+			// nobody waits for the result, stop execution. later callers start a new one
+			c.cancel()
+			if g.calls[key] == c {
+				delete(g.calls, key)
+			}
+		}
+		g.mu.Unlock()
+		return nil, shared, ctx.Err()
+	}
+}
+
+// forget remove call of key, unless it was replaced by a new call after being abandoned
+func (g *flightGroup) forget(key string, c *flightCall) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.calls[key] == c {
+		delete(g.calls, key)
+	}
+}
+
+// FlushCache drop cached results of queries, so they run again on next scrape. returns number of results dropped.
+// with async collect the latest results keep being served, queries are rescheduled to run on next tick instead
+func (s *Server) FlushCache() int {
+	if s.asyncCollect {
+		s.scheduler.nextMtx.Lock()
+		defer s.scheduler.nextMtx.Unlock()
+		n := len(s.scheduler.next)
+		for name := range s.scheduler.next {
+			delete(s.scheduler.next, name)
+		}
+		return n
+	}
+	s.cacheMtx.Lock()
+	defer s.cacheMtx.Unlock()
+	n := len(s.metricCache)
+	s.metricCache = make(map[string]*cachedMetrics)
+	return n
+}
@@ -9,132 +9,14 @@ import (
 	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
+	"math"
 	"strings"
 	"time"
 )
 
-// func (s *Server) getCacheMetrics(name string) *cachedMetrics {
-// 	s.cacheMtx.Lock()
-// 	cachedMetric, found := s.metricCache[name]
-// 	s.cacheMtx.Unlock()
-// 	if found {
-// 		return cachedMetric
-// 	}
-// 	return &cachedMetrics{}
-// }
-//
-// func (s *Server) collectMetrics(prometheusCh chan<- prometheus.Metric) map[string]error {
-// 	var (
-// 		metricCh     = make(chan *cachedMetrics, 100)
-// 		metricErrors = make(map[string]error)
-// 		wg           = sync.WaitGroup{}
-// 		limit        = newRateLimit(s.parallel)
-// 		doneCh       = make(chan struct{})
-// 	)
-// 	go func() {
-// 		select {
-// 		case cacheMetric := <-metricCh:
-// 			if cacheMetric.err != nil {
-// 				metricErrors[cacheMetric.name] = cacheMetric.err
-// 			}
-// 			for _, m := range cacheMetric.metrics {
-// 				prometheusCh <- m
-// 			}
-// 		case <-doneCh:
-// 			return
-// 		}
-// 	}()
-// 	for name, queryInstance := range s.queryInstanceMap {
-// 		cachedMetric := s.getCacheMetrics(name)
-// 		if cachedMetric.IsCollect() {
-// 			log.Debugf("Collect metric [%s] running. auto skip", name)
-// 			continue
-// 		}
-// 		wg.Add(1)
-// 		queryInst := queryInstance
-// 		limit.getToken()
-// 		go func() {
-// 			defer wg.Done()
-// 			defer limit.putToken()
-// 			s.collectMetric(metricCh, queryInst)
-// 		}()
-// 	}
-// 	wg.Wait()
-// 	close(doneCh)
-// 	close(metricCh)
-// 	return metricErrors
-// }
-//
-// func (s *Server) collectMetric(ch chan<- *cachedMetrics, queryInstance *QueryInstance) *cachedMetrics {
-// 	var (
-// 		metricName     = queryInstance.Name
-// 		scrapeMetric   = false // Whether to collect indicators from the database 是否从数据库里采集指标
-// 		cachedMetric   = &cachedMetrics{}
-// 		metrics        []prometheus.Metric
-// 		nonFatalErrors []error
-// 		err            error
-// 	)
-// 	defer func() {
-// 		ch <- cachedMetric
-// 	}()
-// 	querySQL := queryInstance.GetQuerySQL(s.lastMapVersion)
-// 	if querySQL == nil {
-// 		log.Errorf("Collect Metric [%s] not define querySQL for version %s", metricName, s.lastMapVersion.String())
-// 		return nil
-// 	}
-// 	if strings.EqualFold(querySQL.Status, statusDisable) {
-// 		log.Debugf("Collect metric [%s] disable. auto skip", metricName)
-// 		return nil
-// 	}
-// 	cachedMetric = s.getCacheMetrics(metricName)
-// 	// Determine whether to enable caching and cache expiration 判断是否启用缓存和缓存过期
-// 	if !s.disableCache || queryInstance.IsEnableCache() {
-// 		if !cachedMetric.IsValid(queryInstance.TTL) {
-// 			scrapeMetric = true
-// 		}
-// 	} else {
-// 		scrapeMetric = true
-// 	}
-//
-// 	if cachedMetric.err != nil || len(cachedMetric.nonFatalErrors) > 0 {
-// 		scrapeMetric = true
-// 	}
-//
-// 	if !scrapeMetric {
-// 		log.Infof("Collect metric [%s] use cache", metricName)
-// 		return cachedMetric
-// 	}
-//
-// 	cachedMetric.collect = true
-// 	metrics, nonFatalErrors, err = s.doCollectMetric(queryInstance)
-// 	cachedMetric.collect = false
-//
-// 	// Non-serious errors - likely version or parsing problems.
-// 	if len(nonFatalErrors) > 0 {
-// 		var errText string
-// 		for _, err := range nonFatalErrors {
-// 			log.Errorf("Collect metric [%s] nonFatalErrors err %s", metricName, err)
-// 			errText += err.Error()
-// 		}
-// 		err = errors.New(errText)
-// 	}
-// 	if scrapeMetric && queryInstance.TTL > 0 {
-// 		// Only cache if metricName is meaningfully cacheable
-// 		s.cacheMtx.Lock()
-// 		s.metricCache[metricName] = &cachedMetrics{
-// 			metrics:        metrics,
-// 			lastScrape:     time.Now(), // 改为查询完时间
-// 			nonFatalErrors: nonFatalErrors,
-// 			err:            err,
-// 		}
-// 		s.cacheMtx.Unlock()
-// 	}
-// 	return cachedMetric
-// }
-//
-func (s *Server) doCollectMetric(queryInstance *QueryInstance) ([]prometheus.Metric, []error, error) {
+func (s *Server) doCollectMetric(ctx context.Context, queryInstance *QueryInstance) ([]prometheus.Metric, []error, error) {
 	// 根据版本获取查询sql
-	query := queryInstance.GetQuerySQL(s.lastMapVersion, s.primary)
+	query := s.querySQL(queryInstance)
 	if query == nil {
 		// Return success (no pertinent data)
 		return []prometheus.Metric{}, []error{}, nil
@@ -144,7 +26,6 @@ func (s *Server) doCollectMetric(queryInstance *QueryInstance) ([]prometheus.Met
 	var (
 		rows       *sql.Rows
 		err        error
-		ctx        = context.Background()
 		metricName = queryInstance.Name
 	)
 	begin := time.Now()
@@ -152,7 +33,7 @@ func (s *Server) doCollectMetric(queryInstance *QueryInstance) ([]prometheus.Met
 	if query.Timeout > 0 { // if timeout is provided, use context
 		var cancel context.CancelFunc
 		log.Debugf("Collect Metric [%s] executing with time limit: %v", query.Name, query.TimeoutDuration())
-		ctx, cancel = context.WithTimeout(context.Background(), query.TimeoutDuration())
+		ctx, cancel = context.WithTimeout(ctx, query.TimeoutDuration())
 		defer cancel()
 	}
 	log.Debugf("Collect Metric [%s] executing sql %s", queryInstance.Name, query.SQL)
@@ -167,14 +48,17 @@ func (s *Server) doCollectMetric(queryInstance *QueryInstance) ([]prometheus.Met
 
 	log.Debugf("Collect Metric [%s] executing using time %vms", queryInstance.Name, end)
 	if err != nil {
-		if strings.Contains(err.Error(), "context deadline exceeded") {
+		if ctxErr := ctx.Err(); ctxErr != nil || strings.Contains(err.Error(), "context deadline exceeded") {
 			log.Errorf("Collect Metric [%s] executing timeout %v", queryInstance.Name, query.TimeoutDuration())
-			err = fmt.Errorf("timeout %v %s", query.TimeoutDuration(), err)
+			if ctxErr == nil {
+				ctxErr = context.DeadlineExceeded
+			}
+			err = fmt.Errorf("timeout %v %s: %w", query.TimeoutDuration(), err, ctxErr)
 		} else {
 			log.Errorf("Collect Metric [%s] QueryContext err %s", queryInstance.Name, err)
 		}
 		return []prometheus.Metric{}, []error{},
-			fmt.Errorf("Collect Metric [%s] QueryContext on database %q err %s ", metricName, s, err)
+			fmt.Errorf("Collect Metric [%s] QueryContext on database %q err %w ", metricName, s, err)
 	}
 	defer rows.Close()
 	var columnNames []string
@@ -199,8 +83,15 @@ func (s *Server) doCollectMetric(queryInstance *QueryInstance) ([]prometheus.Met
 	nonfatalErrors := []error{}
 
 	metrics := make([]prometheus.Metric, 0)
+	rowCount := 0
 
+rowLoop:
 	for rows.Next() {
+		if query.MaxRows > 0 && rowCount >= query.MaxRows {
+			nonfatalErrors = append(nonfatalErrors, s.truncated(metricName, truncatedRows, query.MaxRows))
+			break
+		}
+		rowCount++
 		err = rows.Scan(scanArgs...)
 		if err != nil {
 			log.Errorf("Collect Metric [%s] executing rows.Scan err %s", queryInstance.Name, err)
@@ -253,9 +144,23 @@ func (s *Server) doCollectMetric(queryInstance *QueryInstance) ([]prometheus.Met
 					    FROM metrics, buckets GROUP BY 1,2
 				*/
 				if col.Histogram {
-
+					var histErr error
+					metric, histErr = histogramMetric(col, columnIdx, columnData, labels)
+					if histErr != nil {
+						nonfatalErrors = append(nonfatalErrors, fmt.Errorf("Collect Metric [%s] column %s %s", metricName, columnName, histErr))
+						continue
+					}
+				} else if strings.EqualFold(col.Usage, MappedMETRIC) && columnData[idx] == nil {
+					// NULL is no value, like NULL of other metric columns
+					metric = prometheus.MustNewConstMetric(col.PrometheusDesc, col.PrometheusType, math.NaN(), labels...)
 				} else if strings.EqualFold(col.Usage, MappedMETRIC) {
-
+					text, _ := dbToString(columnData[idx], s.timeToString)
+					value, ok := col.Mapping[text]
+					if !ok {
+						nonfatalErrors = append(nonfatalErrors, fmt.Errorf("Collect Metric [%s] column %s unmapped value %q", metricName, columnName, text))
+						continue
+					}
+					metric = prometheus.MustNewConstMetric(col.PrometheusDesc, col.PrometheusType, value, labels...)
 				} else {
 					value, ok := dbToFloat64(columnData[idx])
 					if !ok {
@@ -268,8 +173,8 @@ func (s *Server) doCollectMetric(queryInstance *QueryInstance) ([]prometheus.Met
 
 			} else {
 				// Unknown metric. Report as untyped if scan to float64 works, else note an error too.
-				metricLabel := fmt.Sprintf("%s_%s", metricName, columnName)
-				desc := prometheus.NewDesc(metricLabel, fmt.Sprintf("Unknown metric from %s", metricName), queryInstance.LabelNames, s.labels)
+				metricLabel := fmt.Sprintf("%s_%s", queryInstance.MetricPrefix(), columnName)
+				desc := prometheus.NewDesc(metricLabel, fmt.Sprintf("Unknown metric from %s", metricName), queryInstance.LabelList(), s.labels)
 
 				// Its not an error to fail here, since the values are
 				// unexpected anyway.
@@ -280,6 +185,10 @@ func (s *Server) doCollectMetric(queryInstance *QueryInstance) ([]prometheus.Met
 				}
 				metric = prometheus.MustNewConstMetric(desc, prometheus.UntypedValue, value, labels...)
 			}
+			if query.MaxSeries > 0 && len(metrics) >= query.MaxSeries {
+				nonfatalErrors = append(nonfatalErrors, s.truncated(metricName, truncatedSeries, query.MaxSeries))
+				break rowLoop
+			}
 			metrics = append(metrics, metric)
 		}
 	}
@@ -291,3 +200,57 @@ func (s *Server) doCollectMetric(queryInstance *QueryInstance) ([]prometheus.Met
 	log.Debugf("Collect Metric [%s] executing total time %vms", queryInstance.Name, end)
 	return metrics, nonfatalErrors, nil
 }
+
+// truncated record query result exceeded limit, returns the nonfatal error of it
+func (s *Server) truncated(metricName, limit string, max int) error {
+	log.Warnf("Collect Metric [%s] on %s returned more than %d %s, truncated", metricName, s, max, limit)
+	s.queryStats.addTruncated(metricName, limit)
+	return &ErrorTruncated{Query: metricName, Limit: limit, Max: max}
+}
+
+// histogramMetric build a histogram from the le array column, and its <name>_bucket, <name>_sum, <name>_count companions
+func histogramMetric(col *Column, columnIdx map[string]int, columnData []interface{}, labels []string) (prometheus.Metric, error) {
+	keys, ok := dbToFloat64Array(columnData[columnIdx[col.Name]])
+	if !ok {
+		return nil, fmt.Errorf("unexpected histogram le value %v", columnData[columnIdx[col.Name]])
+	}
+
+	bucketIdx, ok := columnIdx[col.Name+"_bucket"]
+	if !ok {
+		return nil, fmt.Errorf("missing histogram column %s_bucket", col.Name)
+	}
+	values, ok := dbToFloat64Array(columnData[bucketIdx])
+	if !ok {
+		return nil, fmt.Errorf("unexpected histogram bucket value %v", columnData[bucketIdx])
+	}
+	if len(keys) != len(values) {
+		return nil, fmt.Errorf("histogram has %d le but %d buckets", len(keys), len(values))
+	}
+	buckets := make(map[float64]uint64, len(keys))
+	for i, key := range keys {
+		if values[i] < 0 {
+			return nil, fmt.Errorf("unexpected histogram bucket value %v", values[i])
+		}
+		buckets[key] = uint64(values[i])
+	}
+
+	sumIdx, ok := columnIdx[col.Name+"_sum"]
+	if !ok {
+		return nil, fmt.Errorf("missing histogram column %s_sum", col.Name)
+	}
+	sum, ok := dbToFloat64(columnData[sumIdx])
+	if !ok {
+		return nil, fmt.Errorf("unexpected histogram sum value %v", columnData[sumIdx])
+	}
+
+	countIdx, ok := columnIdx[col.Name+"_count"]
+	if !ok {
+		return nil, fmt.Errorf("missing histogram column %s_count", col.Name)
+	}
+	count, ok := dbToUint64(columnData[countIdx])
+	if !ok {
+		return nil, fmt.Errorf("unexpected histogram count value %v", columnData[countIdx])
+	}
+
+	return prometheus.NewConstHistogram(col.PrometheusDesc, count, sum, buckets, labels...)
+}
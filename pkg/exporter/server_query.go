@@ -3,47 +3,92 @@
 package exporter
 
 import (
+	"context"
+	"fmt"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // 查询监控指标. 先判断是否读取缓存. 禁用缓存或者缓存超时,则读取数据库
-func (s *Server) queryMetrics(ch chan<- prometheus.Metric) map[string]error {
+func (s *Server) queryMetrics(ctx context.Context, ch chan<- prometheus.Metric) map[string]error {
 	metricErrors := make(map[string]error)
+	var errorsMtx sync.Mutex
+	queryInstanceMap, _ := s.queries()
+	queries := make([]*QueryInstance, 0, len(queryInstanceMap))
+	for _, queryInstance := range queryInstanceMap {
+		queries = append(queries, queryInstance)
+	}
+	s.runQueries(ctx, queries, func(queryInst *QueryInstance) {
+		err := s.queryMetric(ctx, ch, queryInst)
+		if err != nil {
+			errorsMtx.Lock()
+			metricErrors[queryInst.Name] = err
+			errorsMtx.Unlock()
+			// 采集失败个数
+			atomic.AddInt64(&s.ScrapeErrorCount, 1)
+		}
+	})
+
+	return metricErrors
+}
+
+// runQueries run queries in priority order, within the query limit shared by servers.
+// a query whose concurrency class is full waits without holding weight, so queries of other classes run first
+func (s *Server) runQueries(ctx context.Context, queries []*QueryInstance, run func(queryInst *QueryInstance)) {
+	sortQueries(queries)
+	limit := s.queryLimit
+	if limit == nil {
+		limit = newQueryLimit(s.parallel)
+	}
+	classes := s.classLimit
+	if classes == nil {
+		classes = newClassLimit(nil)
+	}
 	wg := sync.WaitGroup{}
-	limit := newRateLimit(s.parallel)
-	for _, queryInstance := range s.queryInstanceMap {
-		metricName := queryInstance.Name
-		// if !s.primary && queryInstance.Primary {
-		// 	log.Infof("Collect Metric %s only run primary. instance is recovery auto skip", metricName)
-		// 	continue
-		// }
+	for len(queries) > 0 {
+		// scrape canceled, do not start remaining queries
+		if ctx.Err() != nil {
+			break
+		}
+		released := classes.releasedCh()
+		idx := -1
+		for i, queryInstance := range queries {
+			if classes.tryGetToken(queryInstance.Class) {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			// all remaining queries wait for their class
+			select {
+			case <-released:
+			case <-ctx.Done():
+			}
+			continue
+		}
+		queryInst := queries[idx]
+		if err := limit.Acquire(ctx, queryInst.Weight); err != nil {
+			classes.putToken(queryInst.Class)
+			break
+		}
+		queries = append(queries[:idx], queries[idx+1:]...)
 		wg.Add(1)
-		queryInst := queryInstance
-
-		limit.getToken()
 		go func() {
 			defer wg.Done()
-			defer limit.putToken()
-			err := s.queryMetric(ch, queryInst)
-			if err != nil {
-				metricErrors[metricName] = err
-				// 采集失败个数
-				s.ScrapeErrorCount++
-			}
+			defer limit.Release(queryInst.Weight)
+			defer classes.putToken(queryInst.Class)
+			run(queryInst)
 		}()
-
 	}
 	wg.Wait()
-
-	return metricErrors
 }
 
-func (s *Server) queryMetric(ch chan<- prometheus.Metric, queryInstance *QueryInstance) error {
+func (s *Server) queryMetric(ctx context.Context, ch chan<- prometheus.Metric, queryInstance *QueryInstance) error {
 	var (
 		metricName     = queryInstance.Name
 		scrapeMetric   = false // Whether to collect indicators from the database 是否从数据库里采集指标
@@ -53,9 +98,14 @@ func (s *Server) queryMetric(ch chan<- prometheus.Metric, queryInstance *QueryIn
 		err            error
 	)
 
-	querySQL := queryInstance.GetQuerySQL(s.lastMapVersion, s.primary)
+	querySQL := s.querySQL(queryInstance)
 	if querySQL == nil {
-		log.Errorf("Collect Metric %s not define querySQL for version %s on %s database ", metricName, s.lastMapVersion.String(), s.DBRole())
+		version, primary := s.versionRole()
+		if queryInstance.GetQuerySQL(version, primary) != nil {
+			log.Debugf("Collect Metric %s not match tags %v of %s. skip", metricName, s.roleTags(primary), s)
+			return nil
+		}
+		log.Errorf("Collect Metric %s not define querySQL for version %s on %s database ", metricName, version.String(), s.DBRole())
 		return nil
 	}
 	if strings.EqualFold(querySQL.Status, statusDisable) {
@@ -64,10 +114,11 @@ func (s *Server) queryMetric(ch chan<- prometheus.Metric, queryInstance *QueryIn
 	}
 
 	// 记录采集成功个数
-	s.ScrapeTotalCount++
+	atomic.AddInt64(&s.ScrapeTotalCount, 1)
 
 	// Determine whether to enable caching and cache expiration 判断是否启用缓存和缓存过期
-	if !s.disableCache {
+	cacheEnabled := querySQL.CacheEnabled(s.disableCache)
+	if cacheEnabled {
 		var found bool
 		// Check if the metric is cached
 		s.cacheMtx.Lock()
@@ -79,17 +130,53 @@ func (s *Server) queryMetric(ch chan<- prometheus.Metric, queryInstance *QueryIn
 		} else if !cachedMetric.IsValid(querySQL.TTL) {
 			scrapeMetric = true
 		}
-		if cachedMetric != nil && (len(cachedMetric.nonFatalErrors) > 0 || len(cachedMetric.metrics) == 0) {
+		// an empty result is cached as well, only failed results are refreshed
+		if cachedMetric != nil && !cachedMetric.IsGood() {
 			scrapeMetric = true
 		}
 	} else {
 		scrapeMetric = true
 	}
+	cacheTTL := querySQL.TTL
+	if !cacheEnabled || cacheTTL < 0 {
+		cacheTTL = 0
+	}
+	if scrapeMetric && !s.breakers.allow(metricName) {
+		log.Debugf("Collect Metric [%s] circuit breaker open. skip", metricName)
+		s.queryStats.addSkipped(metricName, querySkipBreaker)
+		return nil
+	}
+	if scrapeMetric && !s.fitBudget(ctx, metricName) {
+		// shed the query to keep scrape within budget, use last good result if any
+		if last := s.lastGoodMetrics(metricName); last != nil {
+			log.Warnf("Collect Metric [%s] do not fit scrape budget, use result of %s", metricName, last.lastScrape)
+			s.queryStats.addSkipped(metricName, querySkipBudgetCache)
+			for _, m := range last.metrics {
+				ch <- m
+			}
+			return nil
+		}
+		log.Warnf("Collect Metric [%s] do not fit scrape budget, skip", metricName)
+		s.queryStats.addSkipped(metricName, querySkipBudget)
+		return nil
+	}
 	if scrapeMetric {
-		metrics, nonFatalErrors, err = s.doCollectMetric(queryInstance)
+		// concurrent scrapes of the same query share one execution, bounded by the query timeout.
+		// a canceled scrape does not fail the others, the execution is canceled once all scrapes gave up
+		result, shared, waitErr := s.flight.Do(ctx, metricName, func(ctx context.Context) *cachedMetrics {
+			return s.executeMetric(ctx, queryInstance, cacheTTL, querySQL.StaleOnError)
+		})
+		if waitErr != nil {
+			return fmt.Errorf("Collect Metric [%s] wait for execution: %s", metricName, waitErr)
+		}
+		if shared {
+			log.Debugf("Collect Metric [%s] use result of in-flight execution", metricName)
+		}
+		metrics, nonFatalErrors, err = result.metrics, result.nonFatalErrors, result.err
 	} else {
 		log.Debugf("Collect Metric [%s] use cache", metricName)
 		metrics, nonFatalErrors = cachedMetric.metrics, cachedMetric.nonFatalErrors
+		s.queryStats.cacheHit(metricName, cacheTTL, len(metrics))
 	}
 
 	// Serious error - a namespace disappeared
@@ -111,16 +198,84 @@ func (s *Server) queryMetric(ch chan<- prometheus.Metric, queryInstance *QueryIn
 	for _, m := range metrics {
 		ch <- m
 	}
+	return err
+}
 
-	if scrapeMetric && queryInstance.TTL > 0 {
-		// Only cache if metric is meaningfully cacheable
+// executeMetric run query on database, record stats and cache the result.
+// if query failed, the last good result not older than staleOnError seconds is returned instead
+func (s *Server) executeMetric(ctx context.Context, queryInstance *QueryInstance, cacheTTL, staleOnError float64) *cachedMetrics {
+	metricName := queryInstance.Name
+	begin := time.Now()
+	metrics, nonFatalErrors, err := s.doCollectMetric(ctx, queryInstance)
+	s.queryStats.executed(metricName, cacheTTL, len(metrics), time.Since(begin))
+	reason := queryErrorReason(err, nonFatalErrors)
+	if reason != "" {
+		s.queryStats.addError(metricName, reason)
+	}
+	s.updateBreaker(metricName, reason)
+	if err != nil {
+		if stale := s.staleMetrics(metricName, staleOnError); stale != nil {
+			log.Warnf("Collect Metric [%s] err %s, use last good result of %s", metricName, err, stale.lastScrape)
+			s.queryStats.setStale(metricName, true)
+			return stale
+		}
+	}
+	s.queryStats.setStale(metricName, false)
+	result := &cachedMetrics{
+		metrics:        metrics,
+		lastScrape:     time.Now(), // 改为查询完时间
+		nonFatalErrors: nonFatalErrors,
+		err:            err,
+	}
+	if cacheTTL > 0 || staleOnError > 0 {
+		// Only cache if metric is meaningfully cacheable, or kept for failures
 		s.cacheMtx.Lock()
 		s.metricCache[metricName] = &cachedMetrics{
 			metrics:        metrics,
-			lastScrape:     time.Now(), // 改为查询完时间
-			nonFatalErrors: nonFatalErrors,
+			lastScrape:     result.lastScrape,
+			nonFatalErrors: appendError(nonFatalErrors, err),
 		}
 		s.cacheMtx.Unlock()
 	}
-	return err
+	return result
+}
+
+// staleMetrics returns the last good result of query if it is not older than staleOnError seconds
+func (s *Server) staleMetrics(metricName string, staleOnError float64) *cachedMetrics {
+	cachedMetric := s.lastGoodMetrics(metricName)
+	if cachedMetric == nil || !cachedMetric.IsValid(staleOnError) {
+		return nil
+	}
+	return cachedMetric
+}
+
+// lastGoodMetrics returns the cached result of query if it succeed, regardless of its age
+func (s *Server) lastGoodMetrics(metricName string) *cachedMetrics {
+	s.cacheMtx.Lock()
+	cachedMetric, found := s.metricCache[metricName]
+	s.cacheMtx.Unlock()
+	if !found || !cachedMetric.IsGood() {
+		return nil
+	}
+	return cachedMetric
+}
+
+// fitBudget false if the time left before scrape deadline is less than p95 duration of query
+func (s *Server) fitBudget(ctx context.Context, metricName string) bool {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return true
+	}
+	p95, ok := s.queryStats.p95(metricName)
+	if !ok {
+		return true
+	}
+	return time.Until(deadline) >= p95
+}
+
+func appendError(errs []error, err error) []error {
+	if err == nil {
+		return errs
+	}
+	return append(errs[:len(errs):len(errs)], err)
 }
@@ -0,0 +1,204 @@
+// Copyright © 2021 Bin Liu <bin.liu@enmotech.com>
+
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	schedulerTick       = time.Second                  // how often the scheduler look for due queries
+	defaultScheduleTTL  = 60 * time.Second             // interval of queries without positive ttl, and of settings
+	settingsScheduleKey = ""                           // schedule key of pg_settings, query name is never empty
+	foreverScheduleTTL  = time.Duration(math.MaxInt64) // interval of queries cached forever, run once
+)
+
+// scheduler run queries of a server in background on their own ttl, used by async collect
+type scheduler struct {
+	once    sync.Once
+	cancel  context.CancelFunc
+	done    chan struct{} // closed when scheduler stopped
+	ready   chan struct{} // closed after first round, scrape waits for it
+	nextMtx sync.Mutex    // protect next, cleared by cache flush
+	next    map[string]time.Time
+
+	settingsMtx     sync.Mutex
+	settingsMetrics []prometheus.Metric // latest pg_settings metrics
+}
+
+// startScheduler start background scheduler once
+func (s *Server) startScheduler() {
+	s.scheduler.once.Do(func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		s.scheduler.cancel = cancel
+		s.scheduler.done = make(chan struct{})
+		s.scheduler.ready = make(chan struct{})
+		s.scheduler.nextMtx.Lock()
+		s.scheduler.next = make(map[string]time.Time)
+		s.scheduler.nextMtx.Unlock()
+		go s.runScheduler(ctx)
+	})
+}
+
+// stopScheduler stop background scheduler and wait for running queries
+func (s *Server) stopScheduler() {
+	s.scheduler.once.Do(func() {}) // never start after stopped
+	if s.scheduler.cancel == nil {
+		return
+	}
+	s.scheduler.cancel()
+	<-s.scheduler.done
+}
+
+func (s *Server) runScheduler(ctx context.Context) {
+	defer close(s.scheduler.done)
+	ticker := time.NewTicker(schedulerTick)
+	defer ticker.Stop()
+	s.runDueQueries(ctx)
+	close(s.scheduler.ready)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.runDueQueries(ctx)
+		}
+	}
+}
+
+// scheduleInterval interval of query in background scheduler
+func scheduleInterval(queryInstance *QueryInstance) time.Duration {
+	if math.IsInf(queryInstance.TTL, 1) {
+		return foreverScheduleTTL
+	}
+	if queryInstance.TTL > 0 {
+		return time.Duration(queryInstance.TTL * float64(time.Second))
+	}
+	return defaultScheduleTTL
+}
+
+// runDueQueries run queries whose interval elapsed, results are stored in metric cache
+func (s *Server) runDueQueries(ctx context.Context) {
+	if err := s.CheckConn(); err != nil {
+		log.Debugf("scheduler of %s skip round: %s", s, err)
+		return
+	}
+	queryInstanceMap, notCollInternalMetrics := s.queries()
+	now := time.Now()
+	s.scheduler.nextMtx.Lock()
+	settingsDue := !s.disableSettingsMetrics && !notCollInternalMetrics && !now.Before(s.scheduler.next[settingsScheduleKey])
+	if settingsDue {
+		s.scheduler.next[settingsScheduleKey] = now.Add(defaultScheduleTTL)
+	}
+	var due []*QueryInstance
+	for _, queryInstance := range queryInstanceMap {
+		if now.Before(s.scheduler.next[queryInstance.Name]) {
+			continue
+		}
+		s.scheduler.next[queryInstance.Name] = now.Add(scheduleInterval(queryInstance))
+		due = append(due, queryInstance)
+	}
+	s.scheduler.nextMtx.Unlock()
+
+	if settingsDue {
+		metrics, err := bufferMetrics(func(ch chan<- prometheus.Metric) error {
+			return s.querySettings(ctx, ch)
+		})
+		if err != nil {
+			log.Errorf("error retrieving settings on %s: %s", s, err)
+		} else {
+			s.scheduler.settingsMtx.Lock()
+			s.scheduler.settingsMetrics = metrics
+			s.scheduler.settingsMtx.Unlock()
+		}
+	}
+	s.runQueries(ctx, due, func(queryInst *QueryInstance) {
+		s.refreshMetric(ctx, queryInst)
+	})
+}
+
+// refreshMetric execute query and store result in metric cache, the same way a scrape does
+func (s *Server) refreshMetric(ctx context.Context, queryInstance *QueryInstance) {
+	metricName := queryInstance.Name
+	querySQL := s.querySQL(queryInstance)
+	if querySQL == nil || strings.EqualFold(querySQL.Status, statusDisable) {
+		return
+	}
+	if !s.breakers.allow(metricName) {
+		log.Debugf("Collect Metric [%s] circuit breaker open. skip", metricName)
+		s.queryStats.addSkipped(metricName, querySkipBreaker)
+		return
+	}
+	// interval is positive, result is always cached
+	result := s.executeMetric(ctx, queryInstance, scheduleInterval(queryInstance).Seconds(), querySQL.StaleOnError)
+	if !result.IsGood() {
+		atomic.AddInt64(&s.ScrapeErrorCount, 1)
+		log.Errorf("Collect Metric [%s] err %s", metricName, appendError(result.nonFatalErrors, result.err))
+	}
+}
+
+// scrapeSnapshot emit latest results of background scheduler. the first scrape waits for the first round
+func (s *Server) scrapeSnapshot(ctx context.Context, ch chan<- prometheus.Metric) error {
+	s.startScheduler()
+	select {
+	case <-s.scheduler.ready:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	queryInstanceMap, notCollInternalMetrics := s.queries()
+	if !s.disableSettingsMetrics && !notCollInternalMetrics {
+		s.scheduler.settingsMtx.Lock()
+		for _, m := range s.scheduler.settingsMetrics {
+			ch <- m
+		}
+		s.scheduler.settingsMtx.Unlock()
+	}
+
+	var errorsCount int
+	for _, queryInstance := range queryInstanceMap {
+		s.cacheMtx.Lock()
+		cachedMetric, found := s.metricCache[queryInstance.Name]
+		s.cacheMtx.Unlock()
+		if !found {
+			continue
+		}
+		atomic.AddInt64(&s.ScrapeTotalCount, 1)
+		s.queryStats.cacheHit(queryInstance.Name, scheduleInterval(queryInstance).Seconds(), len(cachedMetric.metrics))
+		if !cachedMetric.IsGood() {
+			errorsCount++
+		}
+		for _, m := range cachedMetric.metrics {
+			ch <- m
+		}
+	}
+	if errorsCount > 0 {
+		return fmt.Errorf("queryMetrics returned %d errors", errorsCount)
+	}
+	return nil
+}
+
+// bufferMetrics run f and collect the metrics it emits
+func bufferMetrics(f func(ch chan<- prometheus.Metric) error) ([]prometheus.Metric, error) {
+	metricCh := make(chan prometheus.Metric)
+	doneCh := make(chan struct{})
+	metrics := make([]prometheus.Metric, 0)
+	go func() {
+		for m := range metricCh {
+			metrics = append(metrics, m)
+		}
+		close(doneCh)
+	}()
+	err := f(metricCh)
+	close(metricCh)
+	<-doneCh
+	return metrics, err
+}
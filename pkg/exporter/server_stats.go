@@ -0,0 +1,200 @@
+// Copyright © 2021 Bin Liu <bin.liu@enmotech.com>
+
+package exporter
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reason label of exporter_query_errors_total
+const (
+	queryErrorTimeout = "timeout"     // query timeout or scrape canceled
+	queryErrorSQL     = "sql_error"   // query execution failed
+	queryErrorParse   = "parse_error" // query succeed, but values could not be turned into metrics
+)
+
+// reason label of exporter_query_skipped_total
+const (
+	querySkipBudget      = "budget"       // remaining scrape time could not fit the query
+	querySkipBudgetCache = "budget_cache" // remaining scrape time could not fit the query, served from cache
+	querySkipBreaker     = "breaker_open" // query failed repeatedly, circuit breaker is open
+)
+
+// durationHistorySize number of recent executions used to estimate query duration
+const durationHistorySize = 20
+
+// queryStat internal metrics of one query
+type queryStat struct {
+	cacheTTL   float64            // cache time to live in seconds, 0 if not cached
+	executions float64            // times executed on database
+	cacheHits  float64            // times serving from cache
+	metrics    float64            // number of metrics of last scrape
+	duration   float64            // seconds spend on last execution
+	stale      float64            // 1 if serving last good result after a failure
+	errors     map[string]float64 // reason -> times failed
+	skipped    map[string]float64 // reason -> times skipped
+	truncated  map[string]float64 // limit -> times result truncated
+	history    []time.Duration    // durations of recent executions, ring buffer
+	historyIdx int                // next position of history to write
+}
+
+// queryStats internal metrics of each query, shared by concurrent query goroutines
+type queryStats struct {
+	mu      sync.Mutex
+	queries map[string]*queryStat
+}
+
+// get returns stat of query, must be called with mu held
+func (q *queryStats) get(query string) *queryStat {
+	if q.queries == nil {
+		q.queries = make(map[string]*queryStat)
+	}
+	stat, ok := q.queries[query]
+	if !ok {
+		stat = &queryStat{
+			errors:    make(map[string]float64),
+			skipped:   make(map[string]float64),
+			truncated: make(map[string]float64),
+		}
+		q.queries[query] = stat
+	}
+	return stat
+}
+
+// executed record query executed on database
+func (q *queryStats) executed(query string, ttl float64, metrics int, duration time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	stat := q.get(query)
+	stat.cacheTTL = ttl
+	stat.executions++
+	stat.metrics = float64(metrics)
+	stat.duration = duration.Seconds()
+	if len(stat.history) < durationHistorySize {
+		stat.history = append(stat.history, duration)
+	} else {
+		stat.history[stat.historyIdx] = duration
+	}
+	stat.historyIdx = (stat.historyIdx + 1) % durationHistorySize
+}
+
+// cacheHit record query served from cache
+func (q *queryStats) cacheHit(query string, ttl float64, metrics int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	stat := q.get(query)
+	stat.cacheTTL = ttl
+	stat.cacheHits++
+	stat.metrics = float64(metrics)
+}
+
+func (q *queryStats) setStale(query string, stale bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	stat := q.get(query)
+	stat.stale = 0
+	if stale {
+		stat.stale = 1
+	}
+}
+
+// p95 returns the 95th percentile duration of recent executions, false if query never executed
+func (q *queryStats) p95(query string) (time.Duration, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	stat, ok := q.queries[query]
+	if !ok || len(stat.history) == 0 {
+		return 0, false
+	}
+	durations := make([]time.Duration, len(stat.history))
+	copy(durations, stat.history)
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	idx := int(math.Ceil(float64(len(durations))*0.95)) - 1
+	return durations[idx], true
+}
+
+func (q *queryStats) addSkipped(query, reason string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.get(query).skipped[reason]++
+}
+
+func (q *queryStats) addError(query, reason string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.get(query).errors[reason]++
+}
+
+func (q *queryStats) addTruncated(query, limit string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.get(query).truncated[limit]++
+}
+
+func (q *queryStats) collect(ch chan<- prometheus.Metric, namespace string, labels prometheus.Labels) {
+	newDesc := func(name, help string, variableLabels ...string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "exporter_query", name), help,
+			append([]string{"query"}, variableLabels...), labels)
+	}
+	var (
+		cacheTTLDesc   = newDesc("cache_ttl", "time to live of query cache in seconds, 0 if not cached")
+		executionsDesc = newDesc("executions_total", "times query executed on database")
+		cacheHitsDesc  = newDesc("cache_hits_total", "times query served from cache")
+		metricsDesc    = newDesc("metrics", "number of metrics of last query scrape")
+		durationDesc   = newDesc("duration_seconds", "seconds spend on last query execution")
+		staleDesc      = newDesc("stale", "1 if last good result of query is served after a failure")
+		errorsDesc     = newDesc("errors_total", "times query failed, by reason", "reason")
+		skippedDesc    = newDesc("skipped_total", "times query skipped, by reason", "reason")
+		truncatedDesc  = newDesc("truncated_total", "times query result truncated, by exceeded limit", "limit")
+	)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	queries := make([]string, 0, len(q.queries))
+	for query := range q.queries {
+		queries = append(queries, query)
+	}
+	sort.Strings(queries)
+	for _, query := range queries {
+		stat := q.queries[query]
+		ch <- prometheus.MustNewConstMetric(cacheTTLDesc, prometheus.GaugeValue, stat.cacheTTL, query)
+		ch <- prometheus.MustNewConstMetric(executionsDesc, prometheus.CounterValue, stat.executions, query)
+		ch <- prometheus.MustNewConstMetric(cacheHitsDesc, prometheus.CounterValue, stat.cacheHits, query)
+		ch <- prometheus.MustNewConstMetric(metricsDesc, prometheus.GaugeValue, stat.metrics, query)
+		ch <- prometheus.MustNewConstMetric(durationDesc, prometheus.GaugeValue, stat.duration, query)
+		ch <- prometheus.MustNewConstMetric(staleDesc, prometheus.GaugeValue, stat.stale, query)
+		for reason, count := range stat.errors {
+			ch <- prometheus.MustNewConstMetric(errorsDesc, prometheus.CounterValue, count, query, reason)
+		}
+		for reason, count := range stat.skipped {
+			ch <- prometheus.MustNewConstMetric(skippedDesc, prometheus.CounterValue, count, query, reason)
+		}
+		for limit, count := range stat.truncated {
+			ch <- prometheus.MustNewConstMetric(truncatedDesc, prometheus.CounterValue, count, query, limit)
+		}
+	}
+}
+
+// queryErrorReason classify the error of a query, empty if query succeed
+func queryErrorReason(err error, nonFatalErrors []error) string {
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) ||
+			strings.Contains(err.Error(), "canceling statement due to statement timeout") {
+			return queryErrorTimeout
+		}
+		return queryErrorSQL
+	}
+	for _, err := range nonFatalErrors {
+		if !isTruncated(err) {
+			return queryErrorParse
+		}
+	}
+	return ""
+}
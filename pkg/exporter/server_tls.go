@@ -0,0 +1,67 @@
+// Copyright © 2021 Bin Liu <bin.liu@enmotech.com>
+
+package exporter
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"io/ioutil"
+	"time"
+)
+
+// defaultSSLMode sslmode of driver if dsn does not set it, same as libpq
+const defaultSSLMode = "prefer"
+
+// clientCertExpiry expiry of the first certificate in file, the client certificate itself
+func clientCertExpiry(path string) (time.Time, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	for {
+		var block *pem.Block
+		if block, content = pem.Decode(content); block == nil {
+			return time.Time{}, fmt.Errorf("no certificate found in %s", path)
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("malformed certificate %s: %w", path, err)
+		}
+		return cert.NotAfter, nil
+	}
+}
+
+// collectTLS collect sslmode of connection, and expiry of client certificate if there is one.
+// certificate is read on every scrape, so a rotated one is reported
+func (s *Server) collectTLS(ch chan<- prometheus.Metric) {
+	settings, err := parseDsn(s.dsn)
+	if err != nil {
+		return
+	}
+	mode := settings["sslmode"]
+	if mode == "" {
+		mode = defaultSSLMode
+	}
+	tlsDesc := prometheus.NewDesc(prometheus.BuildFQName(s.namespace, "exporter", "target_tls"),
+		"TLS mode of connection to target, sslmode of dsn", []string{"mode"}, s.labels)
+	ch <- prometheus.MustNewConstMetric(tlsDesc, prometheus.GaugeValue, 1, mode)
+
+	certFile := settings["sslcert"]
+	if certFile == "" {
+		return
+	}
+	expiry, err := clientCertExpiry(certFile)
+	if err != nil {
+		log.Debugf("fail reading client certificate of %s: %s", s, err)
+		return
+	}
+	expiryDesc := prometheus.NewDesc(prometheus.BuildFQName(s.namespace, "exporter", "target_client_cert_expiry_timestamp_seconds"),
+		"expiry of client certificate of connection to target, unix timestamp", nil, s.labels)
+	ch <- prometheus.MustNewConstMetric(expiryDesc, prometheus.GaugeValue, float64(expiry.Unix()))
+}
@@ -3,6 +3,7 @@
 package exporter
 
 import (
+	"context"
 	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
@@ -12,7 +13,7 @@ import (
 )
 
 // QueryInstance the pg_settings view containing runtime variables
-func (s *Server) querySettings(ch chan<- prometheus.Metric) error {
+func (s *Server) querySettings(ctx context.Context, ch chan<- prometheus.Metric) error {
 	log.Debugf("Querying pg_setting view on %q", s.String())
 
 	// pg_settings docs: https://www.postgresql.org/docs/current/static/view-pg-settings.html
@@ -21,7 +22,7 @@ func (s *Server) querySettings(ch chan<- prometheus.Metric) error {
 	// types in normaliseUnit() below
 	query := "SELECT name, setting, COALESCE(unit, ''), short_desc, vartype FROM pg_settings WHERE vartype IN ('bool', 'integer', 'real','string');"
 
-	rows, err := s.db.Query(query)
+	rows, err := s.db.QueryContext(ctx, query)
 	if err != nil {
 		return fmt.Errorf("Error running query on database %q: %s %s ", s.String(), s.namespace, err)
 	}
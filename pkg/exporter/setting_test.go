@@ -3,6 +3,7 @@
 package exporter
 
 import (
+	"context"
 	"fmt"
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/prometheus/client_golang/prometheus"
@@ -43,12 +44,12 @@ func TestServer_querySettings(t *testing.T) {
 				"integer_16MB", "500000", "16MB", "Used to.", "integer").AddRow(
 				"integer_32MB", "500000", "32MB", "Used to.", "integer").AddRow(
 				"integer_64MB", "5000000", "64MB", "Used to.", "integer"))
-		err := s.querySettings(ch)
+		err := s.querySettings(context.Background(), ch)
 		assert.NoError(t, err)
 	})
 	t.Run("querySettings", func(t *testing.T) {
 		mock.ExpectQuery("SELECT").WillReturnError(fmt.Errorf("a1"))
-		err := s.querySettings(ch)
+		err := s.querySettings(context.Background(), ch)
 		assert.Error(t, err)
 	})
 	t.Run("querySettings", func(t *testing.T) {
@@ -56,14 +57,14 @@ func TestServer_querySettings(t *testing.T) {
 			sqlmock.NewRows([]string{"name", "setting", "coalesce", "short_desc", "vartype"}).AddRow(
 				"bool_off", "off", "", "Used to.", "bool").AddRow(
 				"bool_off", "off", "", "Used to.", "bool").RowError(1, fmt.Errorf("error")))
-		err := s.querySettings(ch)
+		err := s.querySettings(context.Background(), ch)
 		assert.Error(t, err)
 	})
 	t.Run("querySettings", func(t *testing.T) {
 		mock.ExpectQuery("SELECT").WillReturnRows(
 			sqlmock.NewRows([]string{"name", "setting", "coalesce", "short_desc", "vartype"}).AddRow(
 				nil, "off", "", "Used to.", "bool"))
-		err := s.querySettings(ch)
+		err := s.querySettings(context.Background(), ch)
 		assert.Error(t, err)
 	})
 	t.Run("normaliseUnit", func(t *testing.T) {
@@ -0,0 +1,359 @@
+// Copyright © 2021 Bin Liu <bin.liu@enmotech.com>
+
+package exporter
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// TargetSource provides dsn of scrape targets. it is resolved on every scrape,
+// so credentials rotated in files take effect without restart
+type TargetSource interface {
+	DSNs() ([]string, error)
+}
+
+// watchedFile content of a file, re-read only when the file changed.
+// kubernetes secrets are rotated by swapping a symlink, stat follows it
+type watchedFile struct {
+	path    string
+	mu      sync.Mutex
+	info    os.FileInfo
+	content string
+}
+
+func newWatchedFile(path string) (*watchedFile, error) {
+	f := &watchedFile{path: path}
+	if _, _, err := f.Read(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Read returns trimmed content of file, changed is true if file is re-read.
+// on error the last content is kept
+func (f *watchedFile) Read() (content string, changed bool, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return f.content, false, fmt.Errorf("fail reading file %s: %w", f.path, err)
+	}
+	if f.info != nil && os.SameFile(f.info, info) && f.info.ModTime().Equal(info.ModTime()) && f.info.Size() == info.Size() {
+		return f.content, false, nil
+	}
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return f.content, false, fmt.Errorf("fail reading file %s: %w", f.path, err)
+	}
+	f.info = info
+	f.content = strings.TrimSpace(string(data))
+	return f.content, true, nil
+}
+
+// urlFileSource dsn list read from file, one dsn per line or comma separated. lines start with # are ignored
+type urlFileSource struct {
+	file *watchedFile
+}
+
+// NewURLFileSource targets of dsn in file, the file is re-read when it changed
+func NewURLFileSource(path string) (TargetSource, error) {
+	file, err := newWatchedFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &urlFileSource{file: file}, nil
+}
+
+func (s *urlFileSource) DSNs() ([]string, error) {
+	content, _, err := s.file.Read()
+	var result []string
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, dsn := range strings.Split(line, ",") {
+			if dsn = strings.TrimSpace(dsn); dsn != "" {
+				result = append(result, dsn)
+			}
+		}
+	}
+	return result, err
+}
+
+// userPassSource targets of uri without credentials, user and password are given separately
+type userPassSource struct {
+	uris     []string
+	user     string
+	password string
+	userFile *watchedFile // overwrite user if not nil
+	passFile *watchedFile // overwrite password if not nil
+}
+
+// NewUserPassSource targets of uri like host:port/database?sslmode=disable, the way of DATA_SOURCE_URI.
+// user and password come from value or file, files are re-read when they changed
+func NewUserPassSource(uris []string, user, userFile, password, passFile string) (TargetSource, error) {
+	s := &userPassSource{user: user, password: password}
+	for _, uri := range uris {
+		if uri = strings.TrimSpace(uri); uri != "" {
+			s.uris = append(s.uris, uri)
+		}
+	}
+	if len(s.uris) == 0 {
+		return nil, fmt.Errorf("target uri is empty")
+	}
+	var err error
+	if userFile != "" {
+		if s.userFile, err = newWatchedFile(userFile); err != nil {
+			return nil, err
+		}
+	}
+	if passFile != "" {
+		if s.passFile, err = newWatchedFile(passFile); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *userPassSource) DSNs() ([]string, error) {
+	var errs []string
+	user, password := s.user, s.password
+	if s.userFile != nil {
+		content, _, err := s.userFile.Read()
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+		user = content
+	}
+	if s.passFile != nil {
+		content, _, err := s.passFile.Read()
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+		password = content
+	}
+	result := make([]string, 0, len(s.uris))
+	for _, uri := range s.uris {
+		if !isURLDSN(uri) {
+			uri = "postgresql://" + uri
+		}
+		settings, err := parseDsn(uri)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if user != "" {
+			settings["user"] = user
+		}
+		if password != "" {
+			settings["password"] = password
+		}
+		result = append(result, genDSNString(settings))
+	}
+	if len(errs) > 0 {
+		return result, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return result, nil
+}
+
+// Target scrape target of targets config
+type Target struct {
+	DSN          string     `yaml:"dsn"`                     // dsn or url without password
+	PasswordFile string     `yaml:"password_file,omitempty"` // file holding password, re-read when it changed
+	TLS          *TargetTLS `yaml:"tls,omitempty"`           // client TLS of connection, instead of ssl settings in dsn
+}
+
+// TargetTLS client TLS settings of target connection, files are read by driver on each new connection
+type TargetTLS struct {
+	Mode     string `yaml:"mode,omitempty"`      // sslmode: disable, allow, prefer, require, verify-ca or verify-full
+	CAFile   string `yaml:"ca_file,omitempty"`   // sslrootcert, CA certificates verifying server
+	CertFile string `yaml:"cert_file,omitempty"` // sslcert, client certificate
+	KeyFile  string `yaml:"key_file,omitempty"`  // sslkey, private key of client certificate
+}
+
+var sslModes = map[string]bool{
+	"disable": true, "allow": true, "prefer": true, "require": true, "verify-ca": true, "verify-full": true,
+}
+
+// settings dsn settings of TLS
+func (t *TargetTLS) settings() map[string]string {
+	settings := make(map[string]string)
+	for key, value := range map[string]string{"sslmode": t.Mode, "sslrootcert": t.CAFile, "sslcert": t.CertFile, "sslkey": t.KeyFile} {
+		if value != "" {
+			settings[key] = value
+		}
+	}
+	return settings
+}
+
+// validate check mode, and that certificates and key could be loaded
+func (t *TargetTLS) validate() error {
+	if t.Mode != "" && !sslModes[t.Mode] {
+		return fmt.Errorf("unknown tls mode %s", t.Mode)
+	}
+	if t.Mode == "disable" && (t.CAFile != "" || t.CertFile != "" || t.KeyFile != "") {
+		return fmt.Errorf("tls files are set while tls mode is disable")
+	}
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return fmt.Errorf("cert_file and key_file must be set together")
+	}
+	if t.CAFile != "" {
+		content, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return fmt.Errorf("fail reading ca_file: %w", err)
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(content) {
+			return fmt.Errorf("no certificate found in ca_file %s", t.CAFile)
+		}
+	}
+	if t.CertFile != "" {
+		if _, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile); err != nil {
+			return fmt.Errorf("fail loading cert_file %s and key_file %s: %w", t.CertFile, t.KeyFile, err)
+		}
+	}
+	return nil
+}
+
+type targetsConfig struct {
+	Targets []*Target `yaml:"targets"`
+}
+
+// ParseTargets turn targets config content into targets
+func ParseTargets(content []byte) ([]*Target, error) {
+	config := &targetsConfig{}
+	if err := yaml.UnmarshalStrict(content, config); err != nil {
+		return nil, fmt.Errorf("malformed targets config: %w", err)
+	}
+	for i, target := range config.Targets {
+		if target == nil || strings.TrimSpace(target.DSN) == "" {
+			return nil, fmt.Errorf("target %d dsn is empty", i)
+		}
+		settings, err := parseDsn(target.DSN)
+		if err != nil {
+			return nil, fmt.Errorf("target %d: %s", i, err)
+		}
+		if _, ok := settings["password"]; ok && target.PasswordFile != "" {
+			return nil, fmt.Errorf("target %d: dsn must not contain password when password_file is set", i)
+		}
+		if target.TLS == nil {
+			continue
+		}
+		if err = target.TLS.validate(); err != nil {
+			return nil, fmt.Errorf("target %d: %s", i, err)
+		}
+		for key := range target.TLS.settings() {
+			if _, ok := settings[key]; ok {
+				return nil, fmt.Errorf("target %d: dsn must not contain %s when it is set by tls", i, key)
+			}
+		}
+	}
+	return config.Targets, nil
+}
+
+// targetsConfigSource targets of targets config file, both the config and password files are re-read when changed
+type targetsConfigSource struct {
+	mu            sync.Mutex
+	file          *watchedFile
+	targets       []*Target
+	passwordFiles map[string]*watchedFile
+}
+
+// NewTargetsConfigSource targets of targets config file
+func NewTargetsConfigSource(path string) (TargetSource, error) {
+	file, err := newWatchedFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &targetsConfigSource{file: file, passwordFiles: map[string]*watchedFile{}}
+	if s.targets, err = s.load(); err != nil {
+		return nil, err
+	}
+	if _, err = s.DSNs(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *targetsConfigSource) load() ([]*Target, error) {
+	content, _, err := s.file.Read()
+	if err != nil {
+		return nil, err
+	}
+	targets, err := ParseTargets([]byte(content))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", s.file.path, err)
+	}
+	return targets, nil
+}
+
+func (s *targetsConfigSource) DSNs() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var errs []string
+	if _, changed, err := s.file.Read(); err != nil {
+		errs = append(errs, err.Error())
+	} else if changed {
+		// malformed config keeps last targets
+		if targets, err := s.load(); err != nil {
+			errs = append(errs, err.Error())
+		} else {
+			s.targets = targets
+		}
+	}
+
+	result := make([]string, 0, len(s.targets))
+	for _, target := range s.targets {
+		if target.PasswordFile == "" && target.TLS == nil {
+			result = append(result, target.DSN)
+			continue
+		}
+		settings, err := parseDsn(target.DSN)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if target.PasswordFile != "" {
+			password, err := s.password(target.PasswordFile)
+			if err != nil {
+				errs = append(errs, err.Error())
+				if _, ok := s.passwordFiles[target.PasswordFile]; !ok {
+					// never read, last password is kept otherwise
+					continue
+				}
+			}
+			settings["password"] = password
+		}
+		if target.TLS != nil {
+			for key, value := range target.TLS.settings() {
+				settings[key] = value
+			}
+		}
+		result = append(result, genDSNString(settings))
+	}
+	if len(errs) > 0 {
+		return result, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return result, nil
+}
+
+// password read password file, must be called with mu held
+func (s *targetsConfigSource) password(path string) (string, error) {
+	file, ok := s.passwordFiles[path]
+	if !ok {
+		var err error
+		if file, err = newWatchedFile(path); err != nil {
+			return "", err
+		}
+		s.passwordFiles[path] = file
+	}
+	password, _, err := file.Read()
+	return password, err
+}
@@ -10,22 +10,79 @@ import (
 	"github.com/prometheus/common/log"
 	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
-// ShadowDSN will hide password part of dsn
+// shadowPassword replaces secrets of dsn in logs
+const shadowPassword = "******"
+
+// sensitiveDSNKeys dsn settings never logged
+var sensitiveDSNKeys = []string{"password", "sslpassword"}
+
+var (
+	shadowKVPattern  = regexp.MustCompile(`(?i)\b((?:ssl)?password\s*=\s*)('(?:[^'\\]|\\.)*'?|[^\s&]*)`)
+	shadowURLPattern = regexp.MustCompile(`^([^:/?#]+://[^:@/?#]*:).*@`)
+)
+
+// ShadowDSN will hide password part of dsn, both url and key=value form.
+// dsn could not be parsed is shadowed by pattern, the result is always safe to log
 func ShadowDSN(dsn string) string {
+	if _, err := parseDsn(dsn); err != nil {
+		return shadowUnparsedDSN(dsn)
+	}
+	if !isURLDSN(dsn) {
+		return shadowKVDSN(dsn)
+	}
 	pDSN, err := url.Parse(dsn)
 	if err != nil {
-		return ""
+		return shadowUnparsedDSN(dsn)
 	}
-	// Blank user info if not nil
 	if pDSN.User != nil {
-		pDSN.User = url.UserPassword(pDSN.User.Username(), "******")
+		if _, ok := pDSN.User.Password(); ok {
+			pDSN.User = url.UserPassword(pDSN.User.Username(), shadowPassword)
+		}
+	}
+	query := pDSN.Query()
+	for _, key := range sensitiveDSNKeys {
+		if _, ok := query[key]; ok {
+			query.Set(key, shadowPassword)
+			pDSN.RawQuery = query.Encode()
+		}
 	}
 	return pDSN.String()
 }
 
+// shadowKVDSN hide values of sensitive keys of a valid key=value dsn in place, the rest is kept as written
+func shadowKVDSN(dsn string) string {
+	var b strings.Builder
+	s := dsn
+	for len(s) > 0 {
+		eqIdx := strings.IndexRune(s, '=')
+		if eqIdx < 0 {
+			b.WriteString(s)
+			break
+		}
+		key := strings.Trim(s[:eqIdx], " \t\n\r\v\f")
+		value := strings.TrimLeft(s[eqIdx+1:], " \t\n\r\v\f")
+		b.WriteString(s[:len(s)-len(value)])
+		end := dsnValueLen(value)
+		if Contains(sensitiveDSNKeys, key) {
+			b.WriteString(shadowPassword)
+		} else {
+			b.WriteString(value[:end])
+		}
+		s = value[end:]
+	}
+	return b.String()
+}
+
+// shadowUnparsedDSN hide anything looks like a password of malformed dsn
+func shadowUnparsedDSN(dsn string) string {
+	dsn = shadowURLPattern.ReplaceAllString(dsn, "${1}"+shadowPassword+"@")
+	return shadowKVPattern.ReplaceAllString(dsn, "${1}"+shadowPassword)
+}
+
 func Contains(a []string, x string) bool {
 	for _, n := range a {
 		if x == n {
@@ -64,6 +121,29 @@ func parseConstLabels(s string) prometheus.Labels {
 	return labels
 }
 
+// parseClassLimits will turn a class=limit comma separated string into a map, limit must be positive
+func parseClassLimits(s string) map[string]int {
+	limits := make(map[string]int)
+	for _, p := range parseCSV(s) {
+		keyValue := strings.Split(p, "=")
+		if len(keyValue) != 2 {
+			log.Errorf(`malformed class limit format %q, should be "class=limit"`, p)
+			continue
+		}
+		class := strings.TrimSpace(keyValue[0])
+		limit, err := strconv.Atoi(strings.TrimSpace(keyValue[1]))
+		if class == "" || err != nil || limit <= 0 {
+			log.Errorf(`malformed class limit %q, limit should be positive integer`, p)
+			continue
+		}
+		limits[class] = limit
+	}
+	if len(limits) == 0 {
+		return nil
+	}
+	return limits
+}
+
 // parseCSV will turn a comma separated string into a []string
 func parseCSV(s string) (tags []string) {
 	s = strings.TrimSpace(s)